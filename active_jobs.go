@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// activeJob a job persisted in active_jobs_file while it runs, found there on start only if IUO stopped in the middle of it
+type activeJob struct {
+	ID      int64     `json:"id"`
+	Started time.Time `json:"started"`
+	// TempFile copy of the upload, left behind by the stopped job
+	TempFile string `json:"temp_file,omitempty"`
+}
+
+// persistedJobs mirror of the file, only touched when a job starts or ends. The jobs map stays the one checked for duplicates
+var persistedJobs = struct {
+	sync.Mutex
+	byKey map[string]activeJob
+}{byKey: make(map[string]activeJob)}
+
+func persistJobStart(key string, id int64) {
+	updateActiveJobs(func(jobs map[string]activeJob) {
+		jobs[key] = activeJob{ID: id, Started: time.Now()}
+	})
+}
+
+func persistJobTempFile(key, tempFile string) {
+	updateActiveJobs(func(jobs map[string]activeJob) {
+		job := jobs[key]
+		job.TempFile = tempFile
+		jobs[key] = job
+	})
+}
+
+func persistJobEnd(key string) {
+	updateActiveJobs(func(jobs map[string]activeJob) {
+		delete(jobs, key)
+	})
+}
+
+func updateActiveJobs(update func(jobs map[string]activeJob)) {
+	if activeJobsFile == "" {
+		return
+	}
+	persistedJobs.Lock()
+	defer persistedJobs.Unlock()
+	update(persistedJobs.byKey)
+	if err := writeActiveJobs(persistedJobs.byKey); err != nil {
+		log.Printf("unable to save active jobs: %v", err)
+	}
+}
+
+// writeActiveJobs replaces the file only once the new one is complete, a crash while writing keeps the previous one
+func writeActiveJobs(jobs map[string]activeJob) error {
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(activeJobsFile), filepath.Base(activeJobsFile)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err = tempFile.Write(data); err == nil {
+		err = tempFile.Chmod(0644)
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), activeJobsFile)
+}
+
+// reconcileActiveJobs the jobs still in the file were interrupted by a crash or a kill: they are logged and their temp file removed.
+// Nothing was uploaded for them, the client uploads the file again
+func reconcileActiveJobs() {
+	if activeJobsFile == "" {
+		return
+	}
+	data, err := os.ReadFile(activeJobsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("unable to read active_jobs_file: %v", err)
+	}
+	var dangling map[string]activeJob
+	if err = json.Unmarshal(data, &dangling); err != nil {
+		log.Printf("active_jobs_file is corrupted, ignoring it: %v", err)
+	}
+	for key, job := range dangling {
+		log.Printf("job %d %s was interrupted by the previous stop, started at %s", job.ID, key, job.Started.Format(time.RFC3339))
+		// Only what IUO could have created, whatever the file says
+		if job.TempFile != "" && strings.HasPrefix(filepath.Base(job.TempFile), "upload-") {
+			if err = os.Remove(job.TempFile); err == nil {
+				log.Printf("removed temp file of interrupted job %d: %s", job.ID, job.TempFile)
+			}
+		}
+	}
+	if err = writeActiveJobs(persistedJobs.byKey); err != nil {
+		log.Fatalf("unable to write active_jobs_file: %v", err)
+	}
+}
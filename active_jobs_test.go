@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readActiveJobs(t *testing.T) map[string]activeJob {
+	t.Helper()
+	data, err := os.ReadFile(activeJobsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs map[string]activeJob
+	if err = json.Unmarshal(data, &jobs); err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestActiveJobsReconcile(t *testing.T) {
+	dir := t.TempDir()
+	previous := activeJobsFile
+	activeJobsFile = filepath.Join(dir, "active_jobs.json")
+	defer func() { activeJobsFile = previous }()
+	persistedJobs.byKey = make(map[string]activeJob)
+	defer func() { persistedJobs.byKey = make(map[string]activeJob) }()
+
+	tempFile := filepath.Join(dir, "upload-123")
+	notOurs := filepath.Join(dir, "photo.jpg")
+	for _, file := range []string{tempFile, notOurs} {
+		if err := os.WriteFile(file, []byte("jpg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	persistJobStart("interrupted", 1)
+	persistJobTempFile("interrupted", tempFile)
+	persistJobStart("forged", 2)
+	persistJobTempFile("forged", notOurs)
+	persistJobStart("done", 3)
+	persistJobEnd("done")
+	jobs := readActiveJobs(t)
+	if len(jobs) != 2 || jobs["interrupted"].ID != 1 || jobs["interrupted"].TempFile != tempFile || jobs["forged"].ID != 2 {
+		t.Fatalf("persisted %+v, want the 2 running jobs", jobs)
+	}
+
+	// IUO started again after a kill: nothing is running
+	persistedJobs.byKey = make(map[string]activeJob)
+	reconcileActiveJobs()
+	if _, err := os.Stat(tempFile); !os.IsNotExist(err) {
+		t.Errorf("temp file of the interrupted job left: %v", err)
+	}
+	if _, err := os.Stat(notOurs); err != nil {
+		t.Errorf("a file IUO didn't create was removed: %v", err)
+	}
+	if jobs = readActiveJobs(t); len(jobs) != 0 {
+		t.Errorf("persisted %+v after reconciling, want none", jobs)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminPathPrefix IUO's own endpoints, never forwarded to immich
+const adminPathPrefix = "/iuo/"
+
+type adminEndpoint struct {
+	handler http.HandlerFunc
+	// public doesn't require the admin token (e.g. health checks)
+	public bool
+}
+
+// adminEndpoints path without adminPathPrefix -> endpoint. A path ending with / also matches the paths below it
+var adminEndpoints = map[string]adminEndpoint{}
+
+func findAdminEndpoint(path string) (adminEndpoint, bool) {
+	path = strings.TrimPrefix(path, adminPathPrefix)
+	if endpoint, ok := adminEndpoints[path]; ok {
+		return endpoint, true
+	}
+	for prefix, endpoint := range adminEndpoints {
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix) {
+			return endpoint, true
+		}
+	}
+	return adminEndpoint{}, false
+}
+
+func isAdminPath(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, adminPathPrefix)
+}
+
+func handleAdminRequest(w http.ResponseWriter, r *http.Request, logger *customLogger) {
+	endpoint, ok := findAdminEndpoint(r.URL.Path)
+	if !endpoint.public && !isAdminAuthorized(r) {
+		logger.Warnf("unauthorized admin request: %s", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="iuo"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	endpoint.handler(w, r)
+}
+
+// isAdminAuthorized accepts the admin token as "Authorization: Bearer <token>" or X-IUO-Token header. No token configured allows everyone
+func isAdminAuthorized(r *http.Request) bool {
+	if adminToken == "" {
+		return true
+	}
+	token := r.Header.Get("X-IUO-Token")
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		token = bearer
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
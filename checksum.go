@@ -1,23 +1,53 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
 	"slices"
-	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
+// SHA1 the built-in implementation already uses the CPU SHA instructions when available, -sha1_command can offload big files
 func SHA1(file io.ReadSeeker) (string, error) {
+	start := time.Now()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", fmt.Errorf("unable to seek end of file: %w", err)
+	}
+	method := "built-in"
+	var hash string
+	if f, ok := file.(*os.File); ok && sha1Command != "" && uint64(size) >= sha1CommandMinSize {
+		if hash, err = externalSHA1(f.Name()); err != nil {
+			log.Printf("sha1_command failed, using built-in: %v", err)
+		} else {
+			method = sha1Command
+		}
+	}
+	if hash == "" {
+		if hash, err = builtinSHA1(file); err != nil {
+			return "", err
+		}
+	}
+	if logHashTiming {
+		elapsed := time.Since(start)
+		log.Printf("sha1 (%s): %s in %s (%.2f MB/s)", method, humanReadableSize(size), elapsed.Round(time.Millisecond), float64(size)/(1<<20)/elapsed.Seconds())
+	}
+	return hash, nil
+}
+
+func builtinSHA1(file io.ReadSeeker) (string, error) {
 	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		return "", fmt.Errorf("unable to seek beginning of file: %w", err)
 	}
@@ -28,64 +58,67 @@ func SHA1(file io.ReadSeeker) (string, error) {
 	return base64.StdEncoding.EncodeToString(hasher.Sum(nil)), nil
 }
 
-var mapLock sync.RWMutex
-var fakeToOriginalChecksum map[string]string
-
-func initChecksums() {
-	fakeToOriginalChecksum = make(map[string]string)
-	file, err := os.OpenFile(checksumsFile, os.O_CREATE|os.O_RDONLY, 0644)
+// externalSHA1 runs sha1_command, its output must start with the hex checksum like sha1sum
+func externalSHA1(filePath string) (string, error) {
+	args := append(strings.Fields(sha1Command), filePath)
+	output, err := exec.Command(args[0], args[1:]...).Output()
 	if err != nil {
-		return
+		return "", err
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		kv := strings.Split(scanner.Text(), ",")
-		fakeToOriginalChecksum[kv[0]] = kv[1]
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", errors.New("empty output")
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Println("Error reading csv:", err)
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha1.Size {
+		return "", fmt.Errorf("unexpected output: %s", fields[0])
 	}
+	return base64.StdEncoding.EncodeToString(sum), nil
 }
 
-func addChecksums(fake, original string) {
-	go func() {
-		mapLock.Lock()
-		fakeToOriginalChecksum[fake] = original
-		mapLock.Unlock()
-		_ = appendToCSV(fake, original)
-	}()
+// uploadChecksum the SHA1 of the upload sent by immich clients in x-immich-checksum, as base64. Clients may send it in hex
+func uploadChecksum(r *http.Request) (string, bool) {
+	return normalizeChecksum(r.Header.Get("x-immich-checksum"))
 }
 
-func appendToCSV(key, value string) error {
-	file, err := os.OpenFile(checksumsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+// normalizeChecksum a SHA1 in base64 or hex, as base64
+func normalizeChecksum(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == sha1.Size {
+		return value, true
 	}
-	defer file.Close()
-	if _, err := io.WriteString(file, key+","+value+"\n"); err != nil {
-		return err
+	if sum, err := hex.DecodeString(value); err == nil && len(sum) == sha1.Size {
+		return base64.StdEncoding.EncodeToString(sum), true
+	}
+	return "", false
+}
+
+func initChecksums() {
+	var err error
+	if checksums, err = newChecksumStore(checksumsBackend, checksumsFile); err != nil {
+		log.Fatalf("unable to open checksums file: %v", err)
+	}
+}
+
+func addChecksums(fake, original string) {
+	if err := checksums.Add(fake, original); err != nil {
+		log.Printf("unable to save checksum mapping: %v", err)
 	}
-	return nil
 }
 
 type Asset map[string]any
 
-// toOriginalAsset: Must acquire mapLock.RLock() before calling
 func (asset Asset) toOriginalAsset() {
-	if downloadJpgFromJxl || downloadJpgFromAvif {
+	if isDownloadConversionEnabled() {
 		if n, ok := asset["originalFileName"]; ok {
-			if originalFileName, ok := n.(string); ok {
-				extension := strings.ToLower(path.Ext(originalFileName))
-				if (downloadJpgFromJxl && extension == ".jxl") || (downloadJpgFromAvif && extension == ".avif") {
-					asset["originalFileName"] = originalFileName + ".jpg"
-				}
+			if originalFileName, ok := n.(string); ok && isConvertedOnDownload(originalFileName) {
+				asset["originalFileName"] = originalFileName + ".jpg"
 			}
 		}
 	}
 	if c, ok := asset["checksum"]; ok {
 		if checksum, ok := c.(string); ok {
-			if original, ok := fakeToOriginalChecksum[checksum]; ok {
+			if original, ok := checksums.Lookup(checksum); ok {
 				//fmt.Printf("checksum: %s -> %s\n", checksum, original)
 				asset["checksum"] = original
 			}
@@ -93,6 +126,21 @@ func (asset Asset) toOriginalAsset() {
 	}
 }
 
+// restoreOriginal replaces the details of the processed file in an upload response with the ones of the file uploaded by the client
+func (asset Asset) restoreOriginal(filename, checksum string) {
+	if _, ok := asset["originalFileName"]; ok {
+		asset["originalFileName"] = filename
+	}
+	if _, ok := asset["originalMimeType"]; ok {
+		if mimeType := mimeTypeByExtension(path.Ext(filename)); mimeType != "" {
+			asset["originalMimeType"] = mimeType
+		}
+	}
+	if _, ok := asset["checksum"]; ok && checksum != "" {
+		asset["checksum"] = checksum
+	}
+}
+
 func getChecksumReplacer(w http.ResponseWriter, r *http.Request, logger *customLogger) *Replacer {
 	if isStreamSync(r) {
 		return &Replacer{w, r, logger, TypeStream}
@@ -151,7 +199,8 @@ func (replacer Replacer) Replace() (err error) {
 		return
 	}
 	defer resp.Body.Close()
-	bodyReader, bodyWriter := getBodyWriterReaderHTTP(&w, resp)
+	var encoded bytes.Buffer
+	bodyReader, bodyWriter := getBodyWriterReaderHTTP(&encoded, resp)
 	defer bodyReader.Close()
 	defer bodyWriter.Close()
 	var jsonBuf []byte
@@ -176,9 +225,7 @@ func (replacer Replacer) Replace() (err error) {
 						continue
 					}
 					if asset, ok := v["data"].(map[string]any); ok {
-						mapLock.RLock()
 						Asset(asset).toOriginalAsset()
-						mapLock.RUnlock()
 					}
 				}
 			}
@@ -189,7 +236,7 @@ func (replacer Replacer) Replace() (err error) {
 				jsonBuf = jsonBuf[1:]
 				jsonBuf[len(jsonBuf)-1] = '\n'
 			}
-			replaceAllBytes(jsonBuf, []byte("},{"), []byte("}\n{"))
+			jsonBuf = replaceAllBytes(jsonBuf, []byte("},{"), []byte("}\n{"))
 		case TypeDelta:
 			assetsKey = "upserted"
 			fallthrough
@@ -203,13 +250,11 @@ func (replacer Replacer) Replace() (err error) {
 					continue
 				}
 				if assets, ok := value.([]any); ok {
-					mapLock.RLock()
 					for _, a := range assets {
 						if asset, ok := a.(map[string]any); ok {
 							Asset(asset).toOriginalAsset()
 						}
 					}
-					mapLock.RUnlock()
 				}
 				break
 			}
@@ -223,11 +268,9 @@ func (replacer Replacer) Replace() (err error) {
 			if err = json.Unmarshal(jsonBuf, &assets); logger.Error(err, "json unmarshal") {
 				return
 			}
-			mapLock.RLock()
 			for _, asset := range assets {
 				asset.toOriginalAsset()
 			}
-			mapLock.RUnlock()
 			if jsonBuf, err = json.Marshal(assets); logger.Error(err, "json marshal") {
 				return
 			}
@@ -236,9 +279,7 @@ func (replacer Replacer) Replace() (err error) {
 			if err = json.Unmarshal(jsonBuf, &asset); logger.Error(err, "json unmarshal") {
 				return
 			}
-			mapLock.RLock()
 			asset.toOriginalAsset()
-			mapLock.RUnlock()
 			if jsonBuf, err = json.Marshal(asset); logger.Error(err, "json marshal") {
 				return
 			}
@@ -248,11 +289,7 @@ func (replacer Replacer) Replace() (err error) {
 		}
 	}
 	setHeaders(w.Header(), resp.Header)
-	if !slices.Contains([]string{"gzip", "br"}, resp.Header.Get("Content-Encoding")) {
-		w.Header().Set("Content-Length", strconv.Itoa(len(jsonBuf)))
-	}
-	w.WriteHeader(resp.StatusCode)
-	if _, err = bodyWriter.Write(jsonBuf); logger.Error(err, "resp write") {
+	if err = writeEncodedBody(w, resp.StatusCode, jsonBuf, bodyWriter, &encoded); logger.Error(err, "resp write") {
 		return
 	}
 	return
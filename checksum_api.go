@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	adminEndpoints["checksums/"] = adminEndpoint{handler: handleChecksumLookup}
+}
+
+type checksumMapping struct {
+	New      string `json:"new"`
+	Original string `json:"original"`
+}
+
+// handleChecksumLookup GET /iuo/checksums/{hash}, hash of the processed file in base64 (URL escaped) or hex.
+// ?reverse=true looks up by the hash of the original and returns all its mappings
+func handleChecksumLookup(w http.ResponseWriter, r *http.Request) {
+	if !checksumsAPI {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Base64 hashes may contain an escaped /
+	value, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), adminPathPrefix+"checksums/"))
+	if err != nil {
+		http.Error(w, "invalid checksum", http.StatusBadRequest)
+		return
+	}
+	hash, ok := normalizeChecksum(value)
+	if !ok {
+		http.Error(w, "invalid checksum, expected a SHA1 in base64 or hex", http.StatusBadRequest)
+		return
+	}
+	var response any
+	if r.URL.Query().Get("reverse") == "true" {
+		var mappings []checksumMapping
+		for _, newHash := range checksums.Reverse(hash) {
+			mappings = append(mappings, checksumMapping{New: newHash, Original: hash})
+		}
+		if len(mappings) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		response = mappings
+	} else {
+		original, ok := checksums.Lookup(hash)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		response = checksumMapping{New: hash, Original: original}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
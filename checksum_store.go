@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// ChecksumStore maps the checksum of an uploaded processed file to the one of the original sent by the client
+type ChecksumStore interface {
+	Add(newHash, originalHash string) error
+	Lookup(newHash string) (originalHash string, ok bool)
+	// Reverse the checksums of the processed files uploaded in place of the original
+	Reverse(originalHash string) (newHashes []string)
+}
+
+var checksums ChecksumStore
+
+func newChecksumStore(backend, path string) (ChecksumStore, error) {
+	switch backend {
+	case "csv":
+		return newCSVChecksumStore(path)
+	case "sqlite":
+		return newSQLiteChecksumStore(path)
+	default:
+		return nil, fmt.Errorf("invalid checksums_backend: %s", backend)
+	}
+}
+
+// csvChecksumStore the whole file is kept in memory, new mappings are appended to it
+type csvChecksumStore struct {
+	path      string
+	lock      sync.RWMutex
+	checksums map[string]string
+}
+
+func newCSVChecksumStore(path string) (*csvChecksumStore, error) {
+	store := &csvChecksumStore{path: path, checksums: make(map[string]string)}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	rows := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		kv := strings.Split(scanner.Text(), ",")
+		if len(kv) == 2 {
+			store.checksums[kv[0]] = kv[1]
+			rows++
+		}
+	}
+	err = scanner.Err()
+	// Closed before compacting, Windows can't replace an open file
+	_ = file.Close()
+	if err != nil {
+		fmt.Println("Error reading csv:", err)
+		// Compacting would drop the rows that couldn't be read
+		return store, nil
+	}
+	if checksumsCompactOnStart && rows > len(store.checksums) {
+		if err = store.compact(); err != nil {
+			log.Printf("checksums compaction failed, the file is unchanged: %v", err)
+		} else {
+			log.Printf("checksums compaction: %d rows collapsed, %d left", rows-len(store.checksums), len(store.checksums))
+		}
+	}
+	return store, nil
+}
+
+// compact rewrites the file with only the latest mapping of each checksum. The new file replaces the old one only once complete
+func (s *csvChecksumStore) compact() error {
+	tempFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".compact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	writer := bufio.NewWriter(tempFile)
+	for newHash, originalHash := range s.checksums {
+		_, _ = writer.WriteString(newHash + "," + originalHash + "\n")
+	}
+	if err = writer.Flush(); err == nil {
+		err = tempFile.Sync()
+	}
+	if err == nil {
+		err = tempFile.Chmod(0644)
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), s.path)
+}
+
+func (s *csvChecksumStore) Add(newHash, originalHash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.checksums[newHash] = originalHash
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.WriteString(file, newHash+","+originalHash+"\n")
+	return err
+}
+
+func (s *csvChecksumStore) Lookup(newHash string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	originalHash, ok := s.checksums[newHash]
+	return originalHash, ok
+}
+
+func (s *csvChecksumStore) Reverse(originalHash string) (newHashes []string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for newHash, original := range s.checksums {
+		if original == originalHash {
+			newHashes = append(newHashes, newHash)
+		}
+	}
+	return newHashes
+}
+
+// sqliteChecksumStore only the index is read on lookup, the file isn't loaded in memory
+type sqliteChecksumStore struct {
+	db *sql.DB
+}
+
+func newSQLiteChecksumStore(path string) (*sqliteChecksumStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes the writes of concurrent jobs, SQLite allows only one writer anyway
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(`PRAGMA journal_mode = WAL;
+CREATE TABLE IF NOT EXISTS checksums (new TEXT PRIMARY KEY, original TEXT NOT NULL) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS checksums_original ON checksums (original);`); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("unable to initialize checksums database: %w", err)
+	}
+	return &sqliteChecksumStore{db: db}, nil
+}
+
+func (s *sqliteChecksumStore) Add(newHash, originalHash string) error {
+	_, err := s.db.Exec("INSERT INTO checksums (new, original) VALUES (?, ?) ON CONFLICT (new) DO UPDATE SET original = excluded.original", newHash, originalHash)
+	return err
+}
+
+func (s *sqliteChecksumStore) Lookup(newHash string) (string, bool) {
+	var originalHash string
+	if err := s.db.QueryRow("SELECT original FROM checksums WHERE new = ?", newHash).Scan(&originalHash); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("checksum lookup failed: %v", err)
+		}
+		return "", false
+	}
+	return originalHash, true
+}
+
+func (s *sqliteChecksumStore) Reverse(originalHash string) (newHashes []string) {
+	rows, err := s.db.Query("SELECT new FROM checksums WHERE original = ?", originalHash)
+	if err != nil {
+		log.Printf("checksum reverse lookup failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var newHash string
+		if err = rows.Scan(&newHash); err != nil {
+			log.Printf("checksum reverse lookup failed: %v", err)
+			return nil
+		}
+		newHashes = append(newHashes, newHash)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("checksum reverse lookup failed: %v", err)
+	}
+	return newHashes
+}
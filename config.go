@@ -1,68 +1,730 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
+	"github.com/google/shlex"
 	"github.com/spf13/viper"
 )
 
 type Task struct {
-	Name             string   `mapstructure:"name"`
-	Extensions       []string `mapstructure:"extensions"`
-	Command          string   `mapstructure:"command"`
-	MinFilesizeBytes int64    `mapstructure:"min_filesize,omitempty"`
-	CommandTemplate  *template.Template
+	Name             string            `mapstructure:"name"`
+	Extensions       []string          `mapstructure:"extensions"`
+	MimeTypes        []string          `mapstructure:"mime_types,omitempty"`
+	Command          string            `mapstructure:"command"`
+	Commands         []string          `mapstructure:"commands,omitempty"`
+	Preprocess       string            `mapstructure:"preprocess,omitempty"`
+	Verify           string            `mapstructure:"verify,omitempty"`
+	PostCommand      string            `mapstructure:"post_command,omitempty"`
+	MinFilesizeBytes int64             `mapstructure:"min_filesize,omitempty"`
+	MaxFilesizeBytes int64             `mapstructure:"max_filesize,omitempty"`
+	MinWidth         uint              `mapstructure:"min_width,omitempty"`
+	MinHeight        uint              `mapstructure:"min_height,omitempty"`
+	SeparateOutput   bool              `mapstructure:"separate_output,omitempty"`
+	StreamUpload     bool              `mapstructure:"stream_upload,omitempty"`
+	Segmented        bool              `mapstructure:"segmented,omitempty"`
+	SegmentDuration  uint              `mapstructure:"segment_duration,omitempty"`
+	SegmentJobs      uint              `mapstructure:"segment_jobs,omitempty"`
+	Timeout          time.Duration     `mapstructure:"timeout,omitempty"`
+	Retries          uint              `mapstructure:"retries,omitempty"`
+	RetryDelay       time.Duration     `mapstructure:"retry_delay,omitempty"`
+	RunAs            string            `mapstructure:"run_as,omitempty"`
+	KeepPolicy       *KeepPolicy       `mapstructure:"keep_policy,omitempty"`
+	PreserveMetadata bool              `mapstructure:"preserve_metadata,omitempty"`
+	Shell            *bool             `mapstructure:"shell,omitempty"`
+	KeepOriginal     *bool             `mapstructure:"keep_original,omitempty"`
+	OutputExtensions []string          `mapstructure:"output_extensions,omitempty"`
+	TempDir          string            `mapstructure:"temp_dir,omitempty"`
+	Binary           string            `mapstructure:"binary,omitempty"`
+	Quality          string            `mapstructure:"quality,omitempty"`
+	Qualities        map[string]string `mapstructure:"qualities,omitempty"`
+	// CommandTemplates command or commands, run in sequence
+	CommandTemplates []*template.Template
+	// PreprocessTemplate nil when the task has no preprocess command
+	PreprocessTemplate *template.Template
+	// VerifyTemplate nil when the task has no verify command
+	VerifyTemplate *template.Template
+	// PostCommandTemplate nil when the task has no post_command
+	PostCommandTemplate *template.Template
+	// runAs parsed RunAs, nil to use the global run_as
+	runAs *commandUser
+	// dir folder of the tasks file defining the task, its commands run there
+	dir string
 }
 
 func (task *Task) Init() (err error) {
-	values := map[string]string{
-		"folder":    "/folder",
-		"name":      "name",
-		"extension": "ext",
+	commands := task.Commands
+	if task.Command != "" {
+		if len(commands) > 0 {
+			err = fmt.Errorf("task %s has both command and commands", task.Name)
+			return
+		}
+		commands = []string{task.Command}
 	}
-
-	task.CommandTemplate, err = template.New("command").Parse(task.Command)
-	if err != nil {
-		err = fmt.Errorf("task %s unable to parse command: %v", task.Name, err)
+	if len(commands) == 0 {
+		err = fmt.Errorf("task %s has no command", task.Name)
 		return
 	}
+	task.CommandTemplates = nil
+	for i, command := range commands {
+		var commandTemplate *template.Template
+		if commandTemplate, err = parseCommandTemplate(fmt.Sprintf("command %d", i+1), command, task.useShell(), templateCheckValues); err != nil {
+			err = fmt.Errorf("task %s: %v", task.Name, err)
+			return
+		}
+		task.CommandTemplates = append(task.CommandTemplates, commandTemplate)
+	}
+
+	if task.KeepPolicy != nil {
+		if err = task.KeepPolicy.validate(); err != nil {
+			err = fmt.Errorf("task %s: keep_policy: %v", task.Name, err)
+			return
+		}
+	}
+
+	if task.RunAs != "" {
+		if task.runAs, err = parseCommandUser(task.RunAs); err != nil {
+			err = fmt.Errorf("task %s: %v", task.Name, err)
+			return
+		}
+	}
+
+	if task.Preprocess != "" {
+		if task.PreprocessTemplate, err = parseCommandTemplate("preprocess command", task.Preprocess, task.useShell(), templateCheckValues); err != nil {
+			err = fmt.Errorf("task %s: %v", task.Name, err)
+			return
+		}
+	}
+
+	if task.Verify != "" {
+		if task.VerifyTemplate, err = parseCommandTemplate("verify command", task.Verify, task.useShell(), templateCheckValues); err != nil {
+			err = fmt.Errorf("task %s: %v", task.Name, err)
+			return
+		}
+	}
+
+	if task.PostCommand != "" {
+		if task.PostCommandTemplate, err = parseCommandTemplate("post_command", task.PostCommand, task.useShell(), postCommandCheckValues); err != nil {
+			err = fmt.Errorf("task %s: %v", task.Name, err)
+			return
+		}
+	}
+
+	return
+}
+
+// templateCheckValues one value for each placeholder of templateValues
+var templateCheckValues = map[string]string{
+	"result_folder":     "/result_folder",
+	"previous_output":   "/folder/name.ext",
+	"original_name":     "b3JpZ2luYWw=",
+	"folder":            "/folder",
+	"name":              "name",
+	"extension":         "ext",
+	"original_basename": "'original'",
+	"original_name_raw": "'original.jpg'",
+	"timestamp":         "1700000000",
+	"job_id":            "1",
+	"gpu_device":        "0",
+	"quality":           "85",
+}
+
+// postCommandCheckValues one value for each placeholder of postCommandValues
+var postCommandCheckValues = map[string]string{
+	"task":               "task",
+	"original_filename":  "'original.jpg'",
+	"processed_filename": "'original.avif'",
+	"original_size":      "2000",
+	"processed_size":     "1000",
+	"original_hash":      "b3JpZ2luYWxfaGFzaA==",
+	"processed_hash":     "cHJvY2Vzc2VkX2hhc2g=",
+	"timestamp":          "1700000000",
+	"job_id":             "1",
+}
 
-	var cmdLine bytes.Buffer
-	err = task.CommandTemplate.Execute(&cmdLine, values)
+// parseCommandTemplate also executes the template with checkValues so a typo in a placeholder fails when loading the config, not on upload.
+// Without shell the result must also split into arguments, e.g. no unbalanced quotes
+func parseCommandTemplate(name, command string, shell bool, checkValues map[string]string) (*template.Template, error) {
+	commandTemplate, err := template.New(name).Option("missingkey=error").Parse(command)
 	if err != nil {
-		err = fmt.Errorf("task %s unable to execute template for command: %v", task.Name, err)
-		return
+		return nil, fmt.Errorf("unable to parse %s: %v", name, err)
+	}
+	var cmdLine strings.Builder
+	if err = commandTemplate.Execute(&cmdLine, checkValues); err != nil {
+		return nil, fmt.Errorf("unable to execute template for %s: %v", name, err)
+	}
+	if !shell {
+		if _, err = splitCommandLine(cmdLine.String()); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return commandTemplate, nil
+}
+
+// keepOriginal task keep_original, falling back to the global flag
+func (task *Task) keepOriginal() bool {
+	if task.KeepOriginal != nil {
+		return *task.KeepOriginal
+	}
+	return keepOriginal
+}
+
+// useShell shell defaults to true, commands run with sh -c
+func (task *Task) useShell() bool {
+	return task.Shell == nil || *task.Shell
+}
+
+// checkFilesize size must be within min_filesize and max_filesize, max_filesize 0 means no maximum
+func (task *Task) checkFilesize(size int64) error {
+	if size < task.MinFilesizeBytes {
+		return fmt.Errorf("file size is smaller than minimum: %d < %d", size, task.MinFilesizeBytes)
 	}
+	if task.MaxFilesizeBytes > 0 && size > task.MaxFilesizeBytes {
+		return fmt.Errorf("file size is bigger than maximum: %d > %d", size, task.MaxFilesizeBytes)
+	}
+	return nil
+}
+
+// minDimensions task min_width/min_height, falling back to the global flags
+func (task *Task) minDimensions() (width, height uint) {
+	width, height = task.MinWidth, task.MinHeight
+	if width == 0 {
+		width = minWidth
+	}
+	if height == 0 {
+		height = minHeight
+	}
+	return
+}
+
+// runAsUser the user running the task commands, nil to keep IUO's user
+func (task *Task) runAsUser() *commandUser {
+	if task.runAs != nil {
+		return task.runAs
+	}
+	return runAsGlobal
+}
+
+// segmentDuration seconds of video in each segment of a segmented task
+func (task *Task) segmentDuration() uint {
+	if task.SegmentDuration == 0 {
+		return defaultSegmentDuration
+	}
+	return task.SegmentDuration
+}
 
+// segmentJobs max segments of a segmented task encoded at the same time, defaults to the number of CPUs
+func (task *Task) segmentJobs() uint {
+	if task.SegmentJobs == 0 {
+		return uint(runtime.NumCPU())
+	}
+	return task.SegmentJobs
+}
+
+// Check reports the problems that would make the task fail or never run, without running it
+func (task *Task) Check() (problems []string) {
+	for _, err := range task.missingBinaries() {
+		problems = append(problems, fmt.Sprintf("binary not found: %v", err))
+	}
+	return append(problems, task.optionProblems()...)
+}
+
+// optionProblems the options that can't work as set, NewConfig refuses the task. Missing binaries are left to strict_binaries
+func (task *Task) optionProblems() (problems []string) {
+	if task.MaxFilesizeBytes > 0 && task.MaxFilesizeBytes < task.MinFilesizeBytes {
+		problems = append(problems, "max_filesize is smaller than min_filesize, the task never runs")
+	}
+	if task.Segmented && task.StreamUpload {
+		problems = append(problems, "segmented and stream_upload can't be used together")
+	}
+	if task.PreserveMetadata && task.StreamUpload {
+		problems = append(problems, "preserve_metadata and stream_upload can't be used together")
+	}
+	if task.Retries > 0 && task.StreamUpload {
+		problems = append(problems, "retries and stream_upload can't be used together, the output is already being uploaded")
+	}
+	if len(task.Extensions) == 0 && len(task.MimeTypes) == 0 {
+		problems = append(problems, "no extensions or mime_types")
+	}
+	for _, mimeType := range task.MimeTypes {
+		if !slices.ContainsFunc(fileSignatures, func(s fileSignature) bool { return s.mimeType == mimeType }) {
+			problems = append(problems, fmt.Sprintf("mime type %s can't be detected", mimeType))
+		}
+	}
+	for _, extension := range task.Extensions {
+		if extension != strings.ToLower(extension) {
+			problems = append(problems, fmt.Sprintf("extension %s must be lowercase", extension))
+		} else if !slices.Contains(imageExtensions, extension) && !slices.Contains(videoExtensions, extension) {
+			problems = append(problems, fmt.Sprintf("extension %s is not an image or video extension accepted by immich", extension))
+		} else if task.Segmented && !slices.Contains(videoExtensions, extension) {
+			problems = append(problems, fmt.Sprintf("extension %s can't be segmented, it's not a video", extension))
+		}
+	}
+	for extension := range task.Qualities {
+		if extension != strings.ToLower(extension) {
+			problems = append(problems, fmt.Sprintf("qualities extension %s must be lowercase", extension))
+		} else if !slices.Contains(imageExtensions, extension) && !slices.Contains(videoExtensions, extension) {
+			problems = append(problems, fmt.Sprintf("qualities extension %s is not an image or video extension accepted by immich", extension))
+		}
+	}
+	if task.TempDir != "" {
+		if info, err := os.Stat(task.TempDir); err != nil {
+			problems = append(problems, fmt.Sprintf("temp_dir: %v", err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("temp_dir %s is not a directory", task.TempDir))
+		}
+	}
+	for _, extension := range task.OutputExtensions {
+		if extension != strings.ToLower(extension) {
+			problems = append(problems, fmt.Sprintf("output extension %s must be lowercase", extension))
+		} else if !slices.Contains(imageExtensions, extension) && !slices.Contains(videoExtensions, extension) {
+			problems = append(problems, fmt.Sprintf("output extension %s is not an image or video extension accepted by immich", extension))
+		}
+	}
+	return
+}
+
+// quality the qualities entry of the extension the task was matched with, quality if it has none
+func (task *Task) quality(extension string) string {
+	if quality, ok := task.Qualities[strings.ToLower(strings.TrimPrefix(extension, "."))]; ok {
+		return quality
+	}
+	return task.Quality
+}
+
+// checkOutputExtension rejects a processed file immich wouldn't accept as an asset, e.g. a log written by a buggy command.
+// Without output_extensions any image or video extension is allowed
+func (task *Task) checkOutputExtension(filePath string) error {
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(filePath), "."))
+	if len(task.OutputExtensions) > 0 {
+		if !slices.Contains(task.OutputExtensions, extension) {
+			return fmt.Errorf("processed file extension %q isn't in output_extensions", extension)
+		}
+		return nil
+	}
+	if !slices.Contains(imageExtensions, extension) && !slices.Contains(videoExtensions, extension) {
+		return fmt.Errorf("processed file extension %q isn't an image or video extension", extension)
+	}
+	return nil
+}
+
+// requiredBinaries the programs the task runs directly
+func (task *Task) requiredBinaries() (binaries []string) {
+	if task.Binary != "" {
+		binaries = append(binaries, binaryPath(task.dir, task.Binary))
+	} else {
+		for _, command := range append([]string{task.Command}, task.Commands...) {
+			binaries = append(binaries, commandBinaries(task.dir, command)...)
+		}
+	}
+	binaries = append(binaries, commandBinaries(task.dir, task.Preprocess)...)
+	binaries = append(binaries, commandBinaries(task.dir, task.Verify)...)
+	binaries = append(binaries, commandBinaries(task.dir, task.PostCommand)...)
+	if task.Segmented {
+		binaries = append(binaries, ffmpegPath, ffprobePath)
+	}
+	if task.PreserveMetadata {
+		binaries = append(binaries, exiftoolPath)
+	}
+	return
+}
+
+// missingBinaries the errors of the required binaries that can't be found
+func (task *Task) missingBinaries() (missing []error) {
+	checked := map[string]bool{}
+	for _, binary := range task.requiredBinaries() {
+		if checked[binary] {
+			continue
+		}
+		checked[binary] = true
+		if _, err := exec.LookPath(binary); err != nil {
+			missing = append(missing, err)
+		}
+	}
+	return
+}
+
+// checkTaskBinaries logs the binaries of the tasks that can't be found, with strict_binaries they're an error
+func (c *Config) checkTaskBinaries() error {
+	missing := 0
+	for _, task := range c.Tasks {
+		for _, err := range task.missingBinaries() {
+			log.Printf("task %s: binary not found: %v", task.Name, err)
+			missing++
+		}
+	}
+	if missing > 0 && strictBinaries {
+		return fmt.Errorf("%d task binaries not found (strict_binaries)", missing)
+	}
+	return nil
+}
+
+// tasksFiles the paths of the comma separated tasks_file list
+func tasksFiles(list string) (files []string) {
+	for _, file := range strings.Split(list, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			files = append(files, file)
+		}
+	}
 	return
 }
 
+// commandBinaries the program a command line runs: leading VAR=value assignments, env and exec are skipped.
+// For sh -c (or bash, dash, zsh) the shell and the program of the inner command. Nothing when the program is a placeholder
+func commandBinaries(dir, command string) []string {
+	args, err := shlex.Split(command)
+	if err != nil {
+		args = strings.Fields(command)
+	}
+	for len(args) > 0 && (isEnvAssignment(args[0]) || args[0] == "exec") {
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "env" {
+		args = args[1:]
+		for len(args) > 0 && (isEnvAssignment(args[0]) || strings.HasPrefix(args[0], "-")) {
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 || strings.Contains(args[0], "{{") {
+		return nil
+	}
+	binaries := []string{binaryPath(dir, args[0])}
+	switch args[0] {
+	case "sh", "bash", "dash", "zsh":
+		if len(args) > 2 && args[1] == "-c" {
+			binaries = append(binaries, commandBinaries(dir, args[2])...)
+		}
+	}
+	return binaries
+}
+
+var envAssignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+func isEnvAssignment(arg string) bool {
+	return envAssignment.MatchString(arg)
+}
+
+// binaryPath relative paths are resolved from the tasks file folder like when running the command
+func binaryPath(dir, binary string) string {
+	if strings.Contains(binary, "/") && !path.IsAbs(binary) {
+		return path.Join(dir, binary)
+	}
+	return binary
+}
+
+type commandUser struct {
+	uid, gid uint32
+}
+
+// parseCommandUser format: uid[:gid], gid defaults to uid
+func parseCommandUser(s string) (*commandUser, error) {
+	uidStr, gidStr, found := strings.Cut(s, ":")
+	if !found {
+		gidStr = uidStr
+	}
+	uid, err := strconv.ParseUint(uidStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid run_as uid: %s", s)
+	}
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid run_as gid: %s", s)
+	}
+	return &commandUser{uid: uint32(uid), gid: uint32(gid)}, nil
+}
+
+// own gives the files to the user so the command can read and write them
+func (user *commandUser) own(paths ...string) error {
+	for _, p := range paths {
+		if err := os.Chown(p, int(user.uid), int(user.gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeepPolicy decides whether the processed file replaces the original
+type KeepPolicy struct {
+	// AlwaysReplace keeps the processed file even if bigger
+	AlwaysReplace bool `mapstructure:"always_replace,omitempty"`
+	// MinSavingsPercent the processed file must be at least this much smaller
+	MinSavingsPercent float64 `mapstructure:"min_savings_percent,omitempty"`
+}
+
+// validate a policy that can't be applied as written, e.g. a saving that no file can reach
+func (p KeepPolicy) validate() error {
+	if p.MinSavingsPercent < 0 || p.MinSavingsPercent >= 100 {
+		return fmt.Errorf("min_savings_percent must be at least 0 and less than 100: %v", p.MinSavingsPercent)
+	}
+	if p.AlwaysReplace && p.MinSavingsPercent > 0 {
+		return errors.New("always_replace and min_savings_percent can't be used together")
+	}
+	return nil
+}
+
+func (p KeepPolicy) keepProcessed(originalSize, processedSize int64) bool {
+	if p.AlwaysReplace {
+		return true
+	}
+	if processedSize >= originalSize {
+		return false
+	}
+	return float64(originalSize-processedSize)*100/float64(originalSize) >= p.MinSavingsPercent
+}
+
 type Config struct {
-	Tasks []*Task `mapstructure:"tasks"`
+	Tasks      []*Task `mapstructure:"tasks"`
+	KeepPolicy struct {
+		Image KeepPolicy `mapstructure:"image"`
+		Video KeepPolicy `mapstructure:"video"`
+	} `mapstructure:"keep_policy"`
+	// ExcludeUsers and ExcludeAlbums IDs whose uploads are sent to immich untouched
+	ExcludeUsers  []string `mapstructure:"exclude_users"`
+	ExcludeAlbums []string `mapstructure:"exclude_albums"`
+	// GPUDevices values of the gpu_device placeholder, given to the jobs in turn
+	GPUDevices []string `mapstructure:"gpu_devices"`
 }
 
-func NewConfig(configFile *string) (*Config, error) {
-	var c *Config
-	var err error
-	viper.SetConfigFile(*configFile)
+// taskForExtension the first task listing the extension whose min_filesize/max_filesize accept size, 0 (unknown size) isn't checked.
+// nil if no task matches, with the size error of the first task rejecting it, if any
+func (c *Config) taskForExtension(extension string, size int64) (*Task, error) {
+	return c.firstTask(size, matchesExtension(extension))
+}
 
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file: %v", err)
+// taskForMimeType like taskForExtension, for the tasks listing the MIME type
+func (c *Config) taskForMimeType(mimeType string, size int64) (*Task, error) {
+	return c.firstTask(size, matchesMimeType(mimeType))
+}
+
+func matchesExtension(extension string) func(task *Task) bool {
+	return func(task *Task) bool { return slices.Contains(task.Extensions, extension) }
+}
+
+func matchesMimeType(mimeType string) func(task *Task) bool {
+	return func(task *Task) bool { return slices.Contains(task.MimeTypes, mimeType) }
+}
+
+// maxFilesize the biggest max_filesize of the matching tasks, 0 if one of them has no maximum. No task accepts a bigger file
+func (c *Config) maxFilesize(matches func(task *Task) bool) int64 {
+	var biggest int64
+	for _, task := range c.Tasks {
+		if !matches(task) {
+			continue
+		}
+		if task.MaxFilesizeBytes == 0 {
+			return 0
+		}
+		biggest = max(biggest, task.MaxFilesizeBytes)
 	}
+	return biggest
+}
 
-	if err := viper.Unmarshal(&c); err != nil {
-		log.Fatalf("Error unmarshaling config: %v", err)
+func (c *Config) firstTask(size int64, matches func(task *Task) bool) (*Task, error) {
+	var sizeErr error
+	for _, task := range c.Tasks {
+		if !matches(task) {
+			continue
+		}
+		if size > 0 {
+			// A later task may accept it, e.g. small and big JPGs processed differently
+			if err := task.checkFilesize(size); err != nil {
+				if sizeErr == nil {
+					sizeErr = err
+				}
+				continue
+			}
+		}
+		return task, nil
+	}
+	return nil, sizeErr
+}
+
+// keepPolicy the task keep_policy or the one of the file class
+func (c *Config) keepPolicy(task *Task, extension string) KeepPolicy {
+	if task.KeepPolicy != nil {
+		return *task.KeepPolicy
+	}
+	if isImageExtension(extension) {
+		return c.KeepPolicy.Image
+	}
+	return c.KeepPolicy.Video
+}
+
+// sharedMatch an extension or MIME type both tasks list, empty if none
+func sharedMatch(task, other *Task) string {
+	for _, extension := range other.Extensions {
+		if slices.Contains(task.Extensions, extension) {
+			return "extension " + extension
+		}
+	}
+	for _, mimeType := range other.MimeTypes {
+		if slices.Contains(task.MimeTypes, mimeType) {
+			return "mime type " + mimeType
+		}
+	}
+	return ""
+}
+
+// sizesOverlap some file size is accepted by both tasks
+func (task *Task) sizesOverlap(other *Task) bool {
+	return (task.MaxFilesizeBytes == 0 || other.MinFilesizeBytes <= task.MaxFilesizeBytes) &&
+		(other.MaxFilesizeBytes == 0 || task.MinFilesizeBytes <= other.MaxFilesizeBytes)
+}
+
+// reloadConfig swaps the config only if the new one is valid, running jobs keep the *Task they already have
+func reloadConfig() {
+	c, err := NewConfig(&configFile)
+	if err != nil {
+		log.Printf("config reload failed, keeping the current one: %v", err)
+		return
 	}
+	if err = c.checkTaskBinaries(); err != nil {
+		log.Printf("config reload failed, keeping the current one: %v", err)
+		return
+	}
+	config.Store(c)
+	log.Printf("config reloaded: %s: %d tasks", configFile, len(c.Tasks))
+}
 
+// NewConfig never exits: a failed reload must keep the current config.
+// configFile is a comma separated list of tasks files, their tasks are matched in file order then in-file order
+func NewConfig(configFile *string) (*Config, error) {
+	c := &Config{}
+	var err error
+	files := tasksFiles(*configFile)
+	if len(files) == 0 {
+		return nil, errors.New("no tasks file")
+	}
+	// The file of each task, to name both files of a conflict
+	taskFiles := map[*Task]string{}
+	conflict := func(task *Task, file string) error {
+		for _, previous := range c.Tasks {
+			sameFile := taskFiles[previous] == file
+			shared := sharedMatch(previous, task)
+			switch {
+			case previous.Name == task.Name:
+				shared = "task " + task.Name
+			case shared == "":
+				continue
+			// Several tasks of a file can list an extension for different sizes, the first one accepting the size runs
+			case sameFile && !previous.sizesOverlap(task):
+				continue
+			}
+			if sameFile {
+				return fmt.Errorf("error validating config: %s is defined twice in %s", shared, file)
+			}
+			return fmt.Errorf("error validating config: %s is in both %s and %s", shared, taskFiles[previous], file)
+		}
+		return nil
+	}
+	keepPolicyFile := ""
+	for _, file := range files {
+		v := viper.New()
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("error reading config file: %v", err)
+		}
+		fileConfig := &Config{}
+		if err := v.Unmarshal(fileConfig); err != nil {
+			return nil, fmt.Errorf("error unmarshaling config %s: %v", file, err)
+		}
+		if v.IsSet("keep_policy") {
+			if keepPolicyFile != "" {
+				return nil, fmt.Errorf("error validating config: keep_policy is in both %s and %s", keepPolicyFile, file)
+			}
+			keepPolicyFile = file
+			c.KeepPolicy = fileConfig.KeepPolicy
+		}
+		for _, task := range fileConfig.Tasks {
+			task.dir = path.Dir(file)
+			// The first match would hide the task
+			if err = conflict(task, file); err != nil {
+				return nil, err
+			}
+			taskFiles[task] = file
+			c.Tasks = append(c.Tasks, task)
+		}
+		c.ExcludeUsers = append(c.ExcludeUsers, fileConfig.ExcludeUsers...)
+		c.ExcludeAlbums = append(c.ExcludeAlbums, fileConfig.ExcludeAlbums...)
+		c.GPUDevices = append(c.GPUDevices, fileConfig.GPUDevices...)
+	}
+
+	if err = c.KeepPolicy.Image.validate(); err != nil {
+		return nil, fmt.Errorf("error validating config: keep_policy image: %v", err)
+	}
+	if err = c.KeepPolicy.Video.validate(); err != nil {
+		return nil, fmt.Errorf("error validating config: keep_policy video: %v", err)
+	}
 	for i := range c.Tasks {
 		err = c.Tasks[i].Init()
 		if err != nil {
 			return nil, fmt.Errorf("error validating config: %v", err)
 		}
+		if problems := c.Tasks[i].optionProblems(); len(problems) > 0 {
+			return nil, fmt.Errorf("error validating config: task %s: %s", c.Tasks[i].Name, strings.Join(problems, ", "))
+		}
+	}
+	if slices.Contains(c.ExcludeUsers, "") || slices.Contains(c.ExcludeAlbums, "") {
+		return nil, fmt.Errorf("error validating config: empty id in exclude_users or exclude_albums")
 	}
 
 	return c, nil
 }
+
+// runConfigCheck validates the tasks file and the job limits, printing a summary. Returns the process exit code
+func runConfigCheck() int {
+	failed := false
+	if maxImageJobs == 0 {
+		fmt.Println("max_image_jobs must be greater than 0")
+		failed = true
+	}
+	if maxVideoJobs == 0 {
+		fmt.Println("max_video_jobs must be greater than 0")
+		failed = true
+	}
+	if maxDownloadJobs == 0 {
+		fmt.Println("max_download_jobs must be greater than 0")
+		failed = true
+	}
+	var err error
+	if runAsFlag != "" {
+		if runAsGlobal, err = parseCommandUser(runAsFlag); err != nil {
+			fmt.Println(err)
+			failed = true
+		}
+	}
+	c, err := NewConfig(&configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("%s: %d tasks\n", configFile, len(c.Tasks))
+	for _, task := range c.Tasks {
+		problems := task.Check()
+		if len(problems) == 0 {
+			fmt.Printf("  %s: ok (%s)\n", task.Name, strings.Join(append(slices.Clip(task.Extensions), task.MimeTypes...), ", "))
+			continue
+		}
+		failed = true
+		fmt.Printf("  %s:\n", task.Name)
+		for _, problem := range problems {
+			fmt.Printf("    - %s\n", problem)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTasksFiles NewConfig of tasks files with these contents, in order
+func loadTasksFiles(t *testing.T, contents ...string) (*Config, error) {
+	t.Helper()
+	dir := t.TempDir()
+	var files []string
+	for i, content := range contents {
+		file := filepath.Join(dir, fmt.Sprintf("tasks%d.yaml", i))
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	list := strings.Join(files, ",")
+	return NewConfig(&list)
+}
+
+func TestNewConfigOptionProblems(t *testing.T) {
+	tests := []struct {
+		name      string
+		extension string
+		options   string
+		wantErr   string
+	}{
+		{"valid", "jpg", "", ""},
+		{"stream_upload and retries", "jpg", "stream_upload: true\n    retries: 1", "retries and stream_upload"},
+		{"segmented and stream_upload", "mp4", "segmented: true\n    stream_upload: true", "segmented and stream_upload"},
+		{"stream_upload and preserve_metadata", "jpg", "stream_upload: true\n    preserve_metadata: true", "preserve_metadata and stream_upload"},
+		{"max_filesize below min_filesize", "jpg", "min_filesize: 10\n    max_filesize: 5", "max_filesize is smaller"},
+		{"uppercase extension", "JPG", "", "must be lowercase"},
+		{"extension immich doesn't accept", "txt", "", "not an image or video extension"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTasksFiles(t, "tasks:\n  - name: copy\n    command: cp {{.folder}}/{{.name}}.{{.extension}} {{.result_folder}}\n    extensions: ["+test.extension+"]\n    "+test.options+"\n")
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewConfigMergedFiles(t *testing.T) {
+	images := "tasks:\n  - name: images\n    command: cp {{.folder}}/{{.name}}.{{.extension}} {{.result_folder}}\n    extensions: [jpg, png]\n"
+	videos := "tasks:\n  - name: videos\n    command: cp {{.folder}}/{{.name}}.{{.extension}} {{.result_folder}}\n    extensions: [mp4]\n"
+	c, err := loadTasksFiles(t, images, videos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for extension, wantTask := range map[string]string{"jpg": "images", "png": "images", "mp4": "videos"} {
+		task, _ := c.taskForExtension(extension, 100)
+		if task == nil || task.Name != wantTask {
+			t.Errorf("%s: task %v, want %s", extension, task, wantTask)
+		}
+	}
+}
+
+func TestNewConfigDuplicates(t *testing.T) {
+	task := func(name, extension, sizes string) string {
+		return "  - name: " + name + "\n    command: cp {{.folder}}/{{.name}}.{{.extension}} {{.result_folder}}\n    extensions: [" + extension + "]\n" + sizes
+	}
+	tests := []struct {
+		name    string
+		files   []string
+		wantErr string
+	}{
+		{"name in one file", []string{"tasks:\n" + task("copy", "jpg", "") + task("copy", "png", "")}, "task copy is defined twice"},
+		{"name in two files", []string{"tasks:\n" + task("copy", "jpg", ""), "tasks:\n" + task("copy", "png", "")}, "task copy is in both"},
+		{"extension in one file", []string{"tasks:\n" + task("a", "jpg", "") + task("b", "jpg", "")}, "extension jpg is defined twice"},
+		{"extension in two files", []string{"tasks:\n" + task("a", "jpg", ""), "tasks:\n" + task("b", "jpg", "")}, "extension jpg is in both"},
+		{"overlapping sizes", []string{"tasks:\n" + task("small", "jpg", "    max_filesize: 2000\n") + task("big", "jpg", "    min_filesize: 1000\n")}, "extension jpg is defined twice"},
+		{"different sizes", []string{"tasks:\n" + task("small", "jpg", "    max_filesize: 1000\n") + task("big", "jpg", "    min_filesize: 1001\n")}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTasksFiles(t, test.files...)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewConfigBadTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		wantErr string
+	}{
+		{"unknown placeholder", "cp {{.folder}}/{{.name}}.{{.extension}} {{.result_folde}}", "map has no entry for key \"result_folde\""},
+		{"malformed", "cp {{.folder}/{{.name}}.{{.extension}} {{.result_folder}}", "unable to parse command 1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTasksFiles(t, "tasks:\n  - name: typo\n    command: "+test.command+"\n    extensions: [jpg]\n")
+			if err == nil || !strings.Contains(err.Error(), "task typo") || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want task typo and %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeepPolicy(t *testing.T) {
+	smaller, always, threshold := KeepPolicy{}, KeepPolicy{AlwaysReplace: true}, KeepPolicy{MinSavingsPercent: 10}
+	tests := []struct {
+		name          string
+		policy        KeepPolicy
+		processedSize int64
+		want          bool
+	}{
+		{"smaller: 1 byte smaller", smaller, 999, true},
+		{"smaller: same size", smaller, 1000, false},
+		{"smaller: 1 byte bigger", smaller, 1001, false},
+		{"always: same size", always, 1000, true},
+		{"always: bigger", always, 2000, true},
+		{"always: smaller", always, 10, true},
+		{"threshold: exactly 10% saved", threshold, 900, true},
+		{"threshold: 1 byte short of 10%", threshold, 901, false},
+		{"threshold: more than 10% saved", threshold, 500, true},
+		{"threshold: same size", threshold, 1000, false},
+		{"threshold: bigger", threshold, 1001, false},
+	}
+	for _, test := range tests {
+		if got := test.policy.keepProcessed(1000, test.processedSize); got != test.want {
+			t.Errorf("%s: keepProcessed(1000, %d) = %v, want %v", test.name, test.processedSize, got, test.want)
+		}
+	}
+}
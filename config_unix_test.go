@@ -0,0 +1,103 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processUpload runs the task of the upload, the content of the processed file
+func processUpload(t *testing.T, taskProcessor *TaskProcessor) string {
+	t.Helper()
+	if err := taskProcessor.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	processed, err := os.ReadFile(taskProcessor.ProcessedFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(processed)
+}
+
+// newUpload a jpg upload given its task by the current config
+func newUpload(t *testing.T) *TaskProcessor {
+	t.Helper()
+	file, header := multipartFile(t, "photo.jpg", []byte("jpg"))
+	taskProcessor, err := newTaskProcessor(context.Background(), file, header.Filename, header.Size, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskProcessor.SetLogger(discardLogger())
+	t.Cleanup(func() { _ = taskProcessor.Close() })
+	return taskProcessor
+}
+
+func writeTasksFile(t *testing.T, path, command string) {
+	t.Helper()
+	tasks := "tasks:\n  - name: jpg\n    command: " + command + "\n    extensions: [jpg]\n    temp_dir: " + filepath.Dir(path) + "\n"
+	if err := os.WriteFile(path, []byte(tasks), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sighup sends SIGHUP to the test process and waits for the config to be replaced, false if it stays the same
+func sighup(t *testing.T, current *Config) bool {
+	t.Helper()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if config.Load() != current {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestReloadConfigOnSIGHUP(t *testing.T) {
+	tasksFile := filepath.Join(t.TempDir(), "tasks.yaml")
+	writeTasksFile(t, tasksFile, `printf first > "{{.result_folder}}/{{.name}}.avif"`)
+	previousConfigFile, previousConfig := configFile, config.Load()
+	configFile = tasksFile
+	t.Cleanup(func() {
+		configFile = previousConfigFile
+		config.Store(previousConfig)
+	})
+	first, err := NewConfig(&configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Store(first)
+	initJobSlots()
+	go reloadConfigOnSIGHUP()
+	// signal.Notify runs in the goroutine, the default action of a SIGHUP arriving before would kill the test
+	time.Sleep(100 * time.Millisecond)
+
+	inFlight := newUpload(t)
+	writeTasksFile(t, tasksFile, `printf second > "{{.result_folder}}/{{.name}}.avif"`)
+	if !sighup(t, first) {
+		t.Fatal("config not reloaded on SIGHUP")
+	}
+	second := config.Load()
+	if got := processUpload(t, newUpload(t)); got != "second" {
+		t.Errorf("upload after reload processed with %q, want the new command", got)
+	}
+	if got := processUpload(t, inFlight); got != "first" {
+		t.Errorf("upload received before reload processed with %q, want the command it started with", got)
+	}
+
+	writeTasksFile(t, tasksFile, `printf broken > "{{.result_folde}}/{{.name}}.avif"`)
+	if sighup(t, second) {
+		t.Fatal("invalid tasks file replaced the config")
+	}
+	if got := processUpload(t, newUpload(t)); got != "second" {
+		t.Errorf("upload after failed reload processed with %q, want the current command", got)
+	}
+}
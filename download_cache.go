@@ -0,0 +1,152 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// convertedCache nil when download_cache_size_mb is 0
+var convertedCache *downloadCache
+
+// downloadCache LRU on disk of the JPGs converted on download
+type downloadCache struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	size    int64
+	entries map[string]*list.Element // Value: *downloadCacheEntry
+	lru     *list.List               // Most recently used first
+	pending map[string]*pendingConversion
+}
+
+type downloadCacheEntry struct {
+	key  string
+	path string
+	size int64
+}
+
+// pendingConversion lets concurrent requests for the same asset wait for a single conversion
+type pendingConversion struct {
+	done chan struct{}
+	err  error
+}
+
+func newDownloadCache(maxSize int64) (*downloadCache, error) {
+	dir, err := os.MkdirTemp("", "download-cache-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create download cache folder: %w", err)
+	}
+	return &downloadCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]*pendingConversion),
+	}, nil
+}
+
+// downloadCacheKey changes when the asset or the conversion output would
+func downloadCacheKey(assetUUID string, asset Asset, conversion *downloadConversion) string {
+	return fmt.Sprintf("%s %v %v %s %s", assetUUID, asset["checksum"], asset["updatedAt"], conversion.binary, downloadOrientation)
+}
+
+// downloadCacheHash names the cached JPG of the key, also its ETag
+func downloadCacheHash(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// open returns the cached JPG, convert creates it when missing and returns its path, it's moved into the cache
+func (c *downloadCache) open(key string, convert func() (string, error)) (*os.File, error) {
+	for {
+		c.lock.Lock()
+		if element, ok := c.entries[key]; ok {
+			c.lru.MoveToFront(element)
+			file, err := os.Open(element.Value.(*downloadCacheEntry).path)
+			c.lock.Unlock()
+			return file, err
+		}
+		if pending, ok := c.pending[key]; ok {
+			c.lock.Unlock()
+			<-pending.done
+			if pending.err != nil {
+				return nil, pending.err
+			}
+			continue
+		}
+		pending := &pendingConversion{done: make(chan struct{})}
+		c.pending[key] = pending
+		c.lock.Unlock()
+
+		file, err := c.convertAndAdd(key, convert)
+		c.lock.Lock()
+		delete(c.pending, key)
+		c.lock.Unlock()
+		pending.err = err
+		close(pending.done)
+		return file, err
+	}
+}
+
+func (c *downloadCache) convertAndAdd(key string, convert func() (string, error)) (*os.File, error) {
+	convertedPath, err := convert()
+	if err != nil {
+		return nil, err
+	}
+	cachedPath := path.Join(c.dir, downloadCacheHash(key)+".jpg")
+	if err = os.Rename(convertedPath, cachedPath); err != nil {
+		_ = os.Remove(convertedPath)
+		return nil, fmt.Errorf("unable to move converted file to the cache: %w", err)
+	}
+	file, err := os.Open(cachedPath)
+	if err != nil {
+		_ = os.Remove(cachedPath)
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		_ = os.Remove(cachedPath)
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = c.lru.PushFront(&downloadCacheEntry{key: key, path: cachedPath, size: stat.Size()})
+	c.size += stat.Size()
+	// The file just added is already open, it can be served even if evicted right away
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		entry := c.lru.Remove(c.lru.Back()).(*downloadCacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		_ = os.Remove(entry.path)
+	}
+	return file, nil
+}
+
+// conversions collapses the concurrent conversions of the same asset when the download cache is disabled
+var conversions singleflight.Group
+
+// convertShared converts once for the requests downloading the same asset at the same time, the JPG is kept in memory to serve all of them.
+// A failed conversion is only returned to the requests already waiting, the next one converts again
+func convertShared(key string, convert func() (string, error)) ([]byte, error) {
+	result, err, _ := conversions.Do(key, func() (any, error) {
+		jpgPath, err := convert()
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(jpgPath)
+		return os.ReadFile(jpgPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]byte), nil
+}
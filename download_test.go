@@ -0,0 +1,28 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDownloadDecoderArgs(t *testing.T) {
+	previousQuality, previousThreads := avifdecQuality, djxlThreads
+	defer func() { avifdecQuality, djxlThreads = previousQuality, previousThreads }()
+	tests := []struct {
+		quality, threads uint
+		wantAvifdec      []string
+		wantDjxl         []string
+	}{
+		{95, 0, []string{"-q", "95", "in", "out"}, []string{"in", "out"}},
+		{60, 2, []string{"-q", "60", "in", "out"}, []string{"--num_threads", "2", "in", "out"}},
+	}
+	for _, test := range tests {
+		avifdecQuality, djxlThreads = test.quality, test.threads
+		if got := avifdecArgs("in", "out"); !slices.Equal(got, test.wantAvifdec) {
+			t.Errorf("avifdec_quality %d: %q, want %q", test.quality, got, test.wantAvifdec)
+		}
+		if got := djxlArgs("in", "out"); !slices.Equal(got, test.wantDjxl) {
+			t.Errorf("djxl_threads %d: %q, want %q", test.threads, got, test.wantDjxl)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDecoder an executable standing for a download conversion binary, script is its shell code: $1 is the original, $2 the JPG to write
+func fakeDecoder(t *testing.T, script string) string {
+	t.Helper()
+	decoder := filepath.Join(t.TempDir(), "decoder")
+	if err := os.WriteFile(decoder, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return decoder
+}
+
+// jxlOriginal the original of every asset of useDownloadConversion
+var jxlOriginal = append([]byte{0xFF, 0x0A}, "jxl"...)
+
+// useDownloadConversion converts JXL to JPG on download with decoder, slots conversions at a time, against an upstream whose assets are all JXL
+func useDownloadConversion(t *testing.T, decoder string, slots int) {
+	t.Helper()
+	previousEnabled, previousSemaphore, previousCache := downloadJpgFromJxl, downloadSemaphore, convertedCache
+	downloadJpgFromJxl, downloadSemaphore, convertedCache = true, make(chan struct{}, slots), nil
+	resolvedDownloadBinaries["djxl"] = decoder
+	t.Cleanup(func() {
+		downloadJpgFromJxl, downloadSemaphore, convertedCache = previousEnabled, previousSemaphore, previousCache
+		delete(resolvedDownloadBinaries, "djxl")
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assetUUID, original := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/assets/"), "/original")
+		if original {
+			_, _ = w.Write(jxlOriginal)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"id":"%s","originalMimeType":"image/jxl","originalFileName":"photo.jxl","checksum":"%s","updatedAt":"2024-01-02T03:04:05.000Z"}`, assetUUID, assetUUID)
+	}))
+	t.Cleanup(server.Close)
+	useUpstream(t, server)
+}
+
+// downloadConverted a client downloading the original of the asset, through the conversion
+func downloadConverted(ctx context.Context, assetUUID string, header http.Header) (*httptest.ResponseRecorder, error) {
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/assets/"+assetUUID+"/original", nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	return w, downloadAndConvertImage(w, r, discardLogger(), assetUUID)
+}
+
+func testAssetUUID(i int) string {
+	return fmt.Sprintf("11111111-2222-3333-4444-%012d", i)
+}
+
+func TestDownloadConversionsBounded(t *testing.T) {
+	dir := t.TempDir()
+	running := filepath.Join(dir, "running")
+	if err := os.Mkdir(running, 0755); err != nil {
+		t.Fatal(err)
+	}
+	counts := filepath.Join(dir, "counts")
+	// Each decoder running holds a file in running and records how many it sees
+	decoder := fakeDecoder(t, fmt.Sprintf(`touch %[1]s/$$; ls %[1]s | wc -l >> %[2]s; sleep 0.2; rm %[1]s/$$; printf jpg > "$2"`, running, counts))
+	useDownloadConversion(t, decoder, 2)
+
+	var wg sync.WaitGroup
+	for i := range 6 {
+		wg.Go(func() {
+			// Different assets, they aren't shared
+			w, err := downloadConverted(context.Background(), testAssetUUID(i), nil)
+			if err != nil || w.Code != http.StatusOK {
+				t.Errorf("download %d: %d, %v", i, w.Code, err)
+			}
+		})
+	}
+	wg.Wait()
+	data, err := os.ReadFile(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []int
+	for _, line := range strings.Fields(string(data)) {
+		count, _ := strconv.Atoi(line)
+		seen = append(seen, count)
+	}
+	if len(seen) != 6 || slices.Max(seen) > 2 {
+		t.Errorf("decoders running at the same time: %v, want 6 runs and at most 2", seen)
+	}
+}
+
+func TestDownloadConversionClientGone(t *testing.T) {
+	useDownloadConversion(t, fakeDecoder(t, `printf jpg > "$2"`), 1)
+	// The only slot is taken by another conversion
+	downloadSemaphore <- struct{}{}
+	defer func() { <-downloadSemaphore }()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := downloadConverted(ctx, testAssetUUID(1), nil); err == nil {
+		t.Fatal("conversion done without a free slot")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %s, the client left after 200ms", elapsed)
+	}
+}
+
+func TestDownloadConversionHeaders(t *testing.T) {
+	useDownloadConversion(t, fakeDecoder(t, `printf jpg > "$2"`), 1)
+	w, err := downloadConverted(context.Background(), testAssetUUID(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "jpg" {
+		t.Fatalf("client got %d %q, want 200 with the JPG", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	want := map[string]string{"Content-Type": "image/jpeg", "Content-Length": "3", "Cache-Control": convertedCacheControl}
+	for key, value := range want {
+		if got := w.Header().Get(key); got != value {
+			t.Errorf("%s: %q, want %q", key, got, value)
+		}
+	}
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 3 {
+		t.Fatalf("ETag: %q, want a quoted hash", etag)
+	}
+	// The browser revalidating its copy
+	w, err = downloadConverted(context.Background(), testAssetUUID(1), http.Header{"If-None-Match": {etag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag || w.Header().Get("Cache-Control") != convertedCacheControl {
+		t.Errorf("revalidation got %d ETag %q Cache-Control %q, want 304 with the same headers", w.Code, w.Header().Get("ETag"), w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestDownloadConversionRange(t *testing.T) {
+	useDownloadConversion(t, fakeDecoder(t, `seq 1 200 > "$2"`), 1)
+	whole, err := downloadConverted(context.Background(), testAssetUUID(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpg := whole.Body.String()
+	if len(jpg) <= 100 {
+		t.Fatalf("converted file of %d bytes, want more than the range", len(jpg))
+	}
+	w, err := downloadConverted(context.Background(), testAssetUUID(1), http.Header{"Range": {"bytes=0-99"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("client got %d, want 206", w.Code)
+	}
+	if got, want := w.Header().Get("Content-Range"), fmt.Sprintf("bytes 0-99/%d", len(jpg)); got != want {
+		t.Errorf("Content-Range: %q, want %q", got, want)
+	}
+	if w.Body.String() != jpg[:100] {
+		t.Errorf("client got %q, want the first 100 bytes %q", w.Body.String(), jpg[:100])
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadUserTTL how long the user of an auth token is remembered, each upload would query immich otherwise
+const uploadUserTTL = 10 * time.Minute
+
+type uploadUser struct {
+	id      string
+	expires time.Time
+}
+
+// uploadUsers user ID by hash of the auth credentials of the request
+var uploadUsers = struct {
+	sync.Mutex
+	byCredentials map[string]uploadUser
+}{byCredentials: make(map[string]uploadUser)}
+
+// authHeaders the ways an immich client authenticates, the cookie is used by the web
+var authHeaders = []string{"X-Api-Key", "Authorization", "X-Immich-User-Token", "X-Immich-Session-Token", "Cookie"}
+
+// excludedUpload the reason an upload must be sent to immich untouched because of exclude_users/exclude_albums, empty if it isn't excluded
+func (c *Config) excludedUpload(r *http.Request, logger *customLogger) string {
+	for _, albumID := range r.MultipartForm.Value["albumId"] {
+		if containsID(c.ExcludeAlbums, albumID) {
+			return fmt.Sprintf("album %s excluded", albumID)
+		}
+	}
+	if len(c.ExcludeUsers) == 0 {
+		return ""
+	}
+	userID, err := uploadUserID(r)
+	if err != nil {
+		// Processed like any other upload, an unknown user must not be excluded
+		logger.Warnf("unable to find the user of the upload, exclude_users not applied: %v", err)
+		return ""
+	}
+	if containsID(c.ExcludeUsers, userID) {
+		return fmt.Sprintf("user %s excluded", userID)
+	}
+	return ""
+}
+
+func containsID(ids []string, id string) bool {
+	return id != "" && slices.ContainsFunc(ids, func(excluded string) bool { return strings.EqualFold(excluded, id) })
+}
+
+// requestCredentials the auth headers of the request and their hash, which tells requesters apart without keeping their secrets.
+// Empty hash without credentials
+func requestCredentials(r *http.Request) (header http.Header, hash string) {
+	hasher := sha256.New()
+	header = http.Header{}
+	for _, key := range authHeaders {
+		for _, value := range r.Header.Values(key) {
+			header.Add(key, value)
+			_, _ = fmt.Fprintf(hasher, "%s: %s\n", key, value)
+		}
+	}
+	if len(header) == 0 {
+		return header, ""
+	}
+	return header, hex.EncodeToString(hasher.Sum(nil))
+}
+
+// uploadUserID asks immich who the credentials of the request belong to
+func uploadUserID(r *http.Request) (string, error) {
+	header, credentials := requestCredentials(r)
+	if credentials == "" {
+		return "", errors.New("no credentials in the request")
+	}
+	uploadUsers.Lock()
+	user, ok := uploadUsers.byCredentials[credentials]
+	uploadUsers.Unlock()
+	if ok && time.Now().Before(user.expires) {
+		return user.id, nil
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, upstreamURL+"/api/users/me", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+	resp, err := getHTTPclient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("/api/users/me: %s", resp.Status)
+	}
+	var me struct {
+		ID string `json:"id"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&me); err != nil {
+		return "", fmt.Errorf("/api/users/me: %w", err)
+	}
+	if me.ID == "" {
+		return "", errors.New("/api/users/me: no user id")
+	}
+	uploadUsers.Lock()
+	for key, user := range uploadUsers.byCredentials {
+		if time.Now().After(user.expires) {
+			delete(uploadUsers.byCredentials, key)
+		}
+	}
+	uploadUsers.byCredentials[credentials] = uploadUser{id: me.ID, expires: time.Now().Add(uploadUserTTL)}
+	uploadUsers.Unlock()
+	return me.ID, nil
+}
@@ -0,0 +1,153 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processAlive a zombie left to a PID 1 that doesn't reap is dead too
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	return err != nil || !strings.Contains(string(stat), ") Z ")
+}
+
+func TestRunTimeoutKillsProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	task := &Task{
+		Name:       "hang",
+		Extensions: []string{"jpg"},
+		// The child outlives sh if only sh is killed
+		Command: "sleep 60 & echo $! > " + pidFile + "; wait",
+		Timeout: 300 * time.Millisecond,
+	}
+	taskProcessor := newTestTaskProcessor(t, task, "photo.jpg", []byte("jpg"))
+	start := time.Now()
+	err := taskProcessor.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "timed out after") {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Run returned after %s", elapsed)
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("child %d of the command survived the timeout", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestOriginalNameRaw(t *testing.T) {
+	for i, filename := range []string{"IMG 0001 (copy).jpg", "it's.jpg", `say "cheese".jpg`, "été 日本 🙂.jpg", "$(touch injected) `id`.jpg", "-n.jpg"} {
+		// Not named after the filename, the temp folders of the test are
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			task := &Task{Name: "raw", Extensions: []string{"jpg"}, Command: `printf '%s' {{.original_name_raw}} > "{{.result_folder}}/{{.name}}.avif"`}
+			taskProcessor := newTestTaskProcessor(t, task, filename, []byte("jpg"))
+			if got := processUpload(t, taskProcessor); got != filename {
+				t.Errorf("command got %q, want %q", got, filename)
+			}
+		})
+	}
+	if _, err := os.Stat("injected"); err == nil {
+		_ = os.Remove("injected")
+		t.Error("a filename ran a command")
+	}
+}
+
+func TestCopyMetadataDateTimeOriginal(t *testing.T) {
+	if _, err := exec.LookPath(exiftoolPath); err != nil {
+		t.Skipf("%s not available: %v", exiftoolPath, err)
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	taskProcessor := newTestTaskProcessor(t, &Task{Name: "metadata", Extensions: []string{"jpg"}, Command: "true"}, "photo.jpg", encoded.Bytes())
+	original := taskProcessor.tempOriginalFilePath
+	if output, err := exec.Command(exiftoolPath, "-q", "-overwrite_original", "-DateTimeOriginal=2021:06:15 10:20:30", original).CombinedOutput(); err != nil {
+		t.Fatalf("tagging the original: %v: %s", err, output)
+	}
+	// Like an encoder dropping the tags
+	processed := filepath.Join(t.TempDir(), "processed.jpg")
+	if err := os.WriteFile(processed, encoded.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := taskProcessor.copyMetadata(context.Background(), original, processed); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(exiftoolPath, "-s3", "-DateTimeOriginal", processed).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(output)), "2021:06:15 10:20:30"; got != want {
+		t.Errorf("DateTimeOriginal of the processed file: %q, want %q", got, want)
+	}
+}
+
+func TestDirectRunnerArguments(t *testing.T) {
+	shell := false
+	for i, filename := range []string{"IMG 0001 (copy).jpg", "it's.jpg", `say "cheese".jpg`, "$(touch injected) `id`.jpg"} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			// No shell runs the command line: sh here only writes the arguments it got, one per line
+			task := &Task{Name: "direct", Extensions: []string{"jpg"}, Shell: &shell,
+				Command: `sh -c 'printf "%s\n" "$@" > "$0"' {{.result_folder}}/{{.name}}.avif {{.original_name_raw}} "two words" 'single quoted' plain`}
+			taskProcessor := newTestTaskProcessor(t, task, filename, []byte("jpg"))
+			want := filename + "\ntwo words\nsingle quoted\nplain\n"
+			if got := processUpload(t, taskProcessor); got != want {
+				t.Errorf("command got the arguments %q, want %q", got, want)
+			}
+		})
+	}
+	if _, err := os.Stat("injected"); err == nil {
+		_ = os.Remove("injected")
+		t.Error("a filename ran a command")
+	}
+}
+
+func TestQualityInCommand(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"photo.HEIC", "90"},
+		{"photo.png", "95"},
+		{"photo.jpg", "85"},
+		// Not in qualities, the task quality
+		{"photo.webp", "80"},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			task := &Task{Name: "avif", Extensions: []string{"heic", "png", "jpg", "webp"}, Quality: "80", Qualities: map[string]string{"heic": "90", "png": "95", "jpg": "85"},
+				Command: `printf '%s' {{.quality}} > "{{.result_folder}}/{{.name}}.avif"`}
+			taskProcessor := newTestTaskProcessor(t, task, test.filename, []byte("original"))
+			if got := processUpload(t, taskProcessor); got != test.want {
+				t.Errorf("command got quality %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// killProcessGroupOnCancel no process groups on windows, only the command itself is killed
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
+
+func runAs(cmd *exec.Cmd, user *commandUser) error {
+	return errors.New("run_as is not supported on windows")
+}
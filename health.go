@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const healthUpstreamTimeout = 5 * time.Second
+
+// readyTTL how long the readiness result is reused, probes would query immich every few seconds otherwise
+const readyTTL = 10 * time.Second
+
+func init() {
+	adminEndpoints["health"] = adminEndpoint{handler: handleHealth, public: true}
+	adminEndpoints["livez"] = adminEndpoint{handler: handleLivez, public: true}
+	adminEndpoints["readyz"] = adminEndpoint{handler: handleReadyz, public: true}
+}
+
+type healthBinary struct {
+	Name  string `json:"name"`
+	Found bool   `json:"found"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthTask struct {
+	Name     string         `json:"name"`
+	Binaries []healthBinary `json:"binaries"`
+}
+
+type healthUpstream struct {
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Healthy  bool           `json:"healthy"`
+	Upstream healthUpstream `json:"upstream"`
+	Tasks    []healthTask   `json:"tasks"`
+	// Download contains the download conversion tools, when enabled
+	Download []healthBinary `json:"download,omitempty"`
+}
+
+// readiness last readiness report, shared by the probes until it expires
+var readiness = struct {
+	sync.Mutex
+	report  healthReport
+	expires time.Time
+}{}
+
+// handleHealth 503 when the upstream is unreachable or a binary needed by a task is missing
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeHealthReport(w, checkHealth(r.Context()))
+}
+
+// handleLivez always 200 while the server answers, the process doesn't need to be restarted
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// handleReadyz same checks as handleHealth, reused for readyTTL. 503 until immich is reachable and the binaries are found
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Concurrent probes wait for the same check instead of starting their own
+	readiness.Lock()
+	if time.Now().After(readiness.expires) {
+		// A probe giving up must not cache a failed check
+		readiness.report = checkHealth(context.WithoutCancel(r.Context()))
+		readiness.expires = time.Now().Add(readyTTL)
+	}
+	report := readiness.report
+	readiness.Unlock()
+	writeHealthReport(w, report)
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// checkHealth checks the upstream and the binaries of the tasks and of the download conversions
+func checkHealth(ctx context.Context) healthReport {
+	report := healthReport{Upstream: checkUpstream(ctx)}
+	report.Healthy = report.Upstream.Reachable
+	for _, task := range config.Load().Tasks {
+		healthTask := healthTask{Name: task.Name}
+		for _, binary := range task.requiredBinaries() {
+			healthTask.Binaries = append(healthTask.Binaries, checkBinary(binary, &report.Healthy))
+		}
+		report.Tasks = append(report.Tasks, healthTask)
+	}
+	for _, conversion := range downloadConversions {
+		if *conversion.enabled {
+			report.Download = append(report.Download, checkBinary(resolvedDownloadBinaries[conversion.binary], &report.Healthy))
+		}
+	}
+	if isDownloadConversionEnabled() && downloadOrientation != "none" {
+		report.Download = append(report.Download, checkBinary(resolvedDownloadBinaries["exiftool"], &report.Healthy))
+		if downloadOrientation == "bake" {
+			report.Download = append(report.Download, checkBinary(resolvedDownloadBinaries["magick"], &report.Healthy))
+		}
+	}
+	return report
+}
+
+// checkBinary healthy is set to false when the binary isn't found
+func checkBinary(name string, healthy *bool) healthBinary {
+	if _, err := exec.LookPath(name); err != nil {
+		*healthy = false
+		return healthBinary{Name: name, Error: err.Error()}
+	}
+	return healthBinary{Name: name, Found: true}
+}
+
+// checkUpstream pings the immich server
+func checkUpstream(ctx context.Context) healthUpstream {
+	ctx, cancel := context.WithTimeout(ctx, healthUpstreamTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL+"/api/server/ping", nil)
+	if err != nil {
+		return healthUpstream{Error: err.Error()}
+	}
+	resp, err := getHTTPclient().Do(req)
+	if err != nil {
+		return healthUpstream{Error: err.Error()}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return healthUpstream{Error: resp.Status}
+	}
+	return healthUpstream{Reachable: true}
+}
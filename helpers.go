@@ -3,25 +3,57 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/time/rate"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-var filterFormKey = "assetData"
+// rawDownloadParam query param that skips the JXL/AVIF to JPG conversion of an original download
+const rawDownloadParam = "raw"
 
 // All images accepted by immich: https://github.com/immich-app/immich/blob/main/server/src/utils/mime-types.ts
 var imageExtensions = []string{"3fr", "ari", "arw", "cap", "cin", "cr2", "cr3", "crw", "dcr", "dng", "erf", "fff", "iiq", "k25", "kdc", "mrw", "nef", "nrw", "orf", "ori", "pef", "psd", "raf", "raw", "rw2", "rwl", "sr2", "srf", "srw", "x3f", "avif", "gif", "jpeg", "jpg", "png", "webp", "bmp", "heic", "heif", "hif", "insp", "jp2", "jpe", "jxl", "svg", "tif", "tiff"}
 
+// isImageExtension with or without the dot, anything else is handled as a video
+func isImageExtension(extension string) bool {
+	return slices.Contains(imageExtensions, strings.ToLower(strings.TrimPrefix(extension, ".")))
+}
+
+// All videos accepted by immich
+var videoExtensions = []string{"3gp", "3gpp", "avi", "flv", "insv", "m2t", "m2ts", "m4v", "mkv", "mov", "mp4", "mpe", "mpeg", "mpg", "mts", "vob", "webm", "wmv"}
+
+// isAssetsUpload the requests carrying a file processed by the tasks: a new asset, or the replacement of the file of an existing one
 func isAssetsUpload(r *http.Request) bool {
-	return r.Method == "POST" && r.URL.Path == "/api/assets" && strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return false
+	}
+	return (r.Method == "POST" && r.URL.Path == "/api/assets") || isAssetReplace(r)
+}
+
+// isAssetReplace PUT /api/assets/{id}/original, deprecated by immich but still sent by older clients. Same form as a new asset
+func isAssetReplace(r *http.Request) bool {
+	re := regexp.MustCompile(`^/api/assets/[a-z0-9]{8}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{12}/original$`)
+	return r.Method == "PUT" && re.MatchString(r.URL.Path)
 }
 
 func isStreamSync(r *http.Request) bool {
@@ -52,15 +84,44 @@ func isAssetView(r *http.Request) bool {
 
 func isOriginalDownloadPath(r *http.Request) (bool, []string) {
 	re := regexp.MustCompile(`^/api/assets/([a-z0-9]{8}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{12})/original$`)
-	matches := re.FindStringSubmatch(r.URL.String())
+	matches := re.FindStringSubmatch(r.URL.Path)
 	return r.Method == "GET" && len(matches) == 2, matches
 }
 
+// takeRawDownloadParam reports whether the client asked for the genuine original with ?raw=1 and removes the param, immich doesn't know it
+func takeRawDownloadParam(r *http.Request) bool {
+	query := r.URL.Query()
+	if !query.Has(rawDownloadParam) {
+		return false
+	}
+	raw, err := strconv.ParseBool(query.Get(rawDownloadParam))
+	query.Del(rawDownloadParam)
+	r.URL.RawQuery = query.Encode()
+	return err == nil && raw
+}
+
+// isAllowedPath matches the cleaned path against the allowed_paths prefixes, whole segments only: /api/asset doesn't allow /api/assets.
+// A prefix with or without its trailing "/" is the same
+func isAllowedPath(p string) bool {
+	if len(allowedPaths) == 0 {
+		return true
+	}
+	p = path.Clean("/" + p)
+	for _, prefix := range allowedPaths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceAllBytes in place when old and new have the same length, otherwise into a new slice: always use the returned slice
 func replaceAllBytes(byteSlice []byte, old []byte, new []byte) []byte {
 	oldLen := len(old)
 	newLen := len(new)
-	if newLen > oldLen {
-		return byteSlice
+	if newLen != oldLen || oldLen == 0 {
+		return bytes.ReplaceAll(byteSlice, old, new)
 	}
 	offset := 0
 	for {
@@ -103,6 +164,91 @@ func isValidFilename(s string) bool {
 	return re.MatchString(s)
 }
 
+func isUnsafeFilenameRune(r rune) bool {
+	return r == '/' || r == '\\' || unicode.IsControl(r)
+}
+
+// validateFilename checks the whole uploaded filename, not just its extension
+func validateFilename(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("invalid filename: %q", name)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("filename is not valid UTF-8: %q", name)
+	case maxFilenameLength > 0 && uint(len(name)) > maxFilenameLength:
+		return fmt.Errorf("filename is too long: %d > %d bytes", len(name), maxFilenameLength)
+	case strings.ContainsFunc(name, isUnsafeFilenameRune):
+		return fmt.Errorf("filename contains path separators or control characters: %q", name)
+	}
+	return nil
+}
+
+// sanitizeFilename replaces unsafe characters and shortens the name (keeping its extension) to fit max_filename_length
+func sanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if isUnsafeFilenameRune(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		name = "upload"
+	}
+	if maxFilenameLength > 0 && uint(len(name)) > maxFilenameLength {
+		ext := path.Ext(name)
+		if uint(len(ext)) >= maxFilenameLength {
+			ext = ""
+		}
+		stem := strings.TrimSuffix(name, ext)
+		limit := int(maxFilenameLength) - len(ext)
+		// Don't cut a multibyte character in half
+		for limit > 0 && !utf8.RuneStart(stem[limit]) {
+			limit--
+		}
+		name = stem[:limit] + ext
+	}
+	return name
+}
+
+// isCreatedBeforeCutoff checks the fileCreatedAt form field against optimize_after, a missing or invalid date is never before the cutoff
+func isCreatedBeforeCutoff(formValues map[string][]string) (bool, time.Time) {
+	if optimizeAfter.IsZero() || len(formValues["fileCreatedAt"]) == 0 {
+		return false, time.Time{}
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, formValues["fileCreatedAt"][0])
+	if err != nil {
+		return false, time.Time{}
+	}
+	return createdAt.Before(optimizeAfter), createdAt
+}
+
+// isLivePhotoUpload the still of a live photo is sent with the ID of its motion video, uploaded before it as a hidden asset.
+// isVisible is the field sent by older apps, visibility by newer ones
+func isLivePhotoUpload(formValues map[string][]string) bool {
+	if values := formValues["livePhotoVideoId"]; len(values) > 0 && values[0] != "" {
+		return true
+	}
+	if values := formValues["visibility"]; len(values) > 0 && values[0] == "hidden" {
+		return true
+	}
+	values := formValues["isVisible"]
+	return len(values) > 0 && values[0] == "false"
+}
+
+// declaredFileSize the fileSize form field sent by immich clients, 0 if missing or malformed
+func declaredFileSize(formValues map[string][]string) int64 {
+	values := formValues["fileSize"]
+	if len(values) == 0 {
+		return 0
+	}
+	size, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
 func printVersion() string {
 	return fmt.Sprintf("immich-upload-optimizer %s, commit %s, built at %s", version, commit, date)
 }
@@ -118,14 +264,137 @@ func validateInput() {
 		log.Fatalf("invalid upstream URL: %v", err)
 	}
 
+	if upstreamCAFile != "" {
+		if upstreamRootCAs, err = loadUpstreamCAs(upstreamCAFile); err != nil {
+			log.Fatalf("invalid upstream_ca_file: %v", err)
+		}
+	}
+	if upstreamInsecureSkipVerify {
+		log.Printf("upstream_insecure_skip_verify is set, the certificate of the upstream isn't verified")
+	}
+
+	if webhookURL != "" {
+		if webhook, err := url.Parse(webhookURL); err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+			log.Fatalf("invalid webhook_url: %s", webhookURL)
+		}
+	}
+
+	for _, addr := range strings.Split(listenAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			listenAddrs = append(listenAddrs, addr)
+		}
+	}
+	if len(listenAddrs) == 0 {
+		log.Fatalf("invalid listen: %s", listenAddr)
+	}
+
+	for _, prefix := range strings.Split(allowedPathsList, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			allowedPaths = append(allowedPaths, prefix)
+		}
+	}
+
+	if optimizeAfterFlag != "" {
+		if optimizeAfter, err = time.Parse(time.RFC3339, optimizeAfterFlag); err != nil {
+			if optimizeAfter, err = time.Parse(time.DateOnly, optimizeAfterFlag); err != nil {
+				log.Fatalf("invalid optimize_after date: %s", optimizeAfterFlag)
+			}
+		}
+	}
+
+	switch duplicateJob {
+	case "reject", "wait", "accept":
+	default:
+		log.Fatalf("invalid duplicate_job: %s", duplicateJob)
+	}
+
+	switch downloadOrientation {
+	case "none", "copy", "bake":
+	default:
+		log.Fatalf("invalid download_orientation: %s", downloadOrientation)
+	}
+
+	if avifdecQuality > 100 {
+		log.Fatalf("invalid avifdec_quality: %d, must be between 0 and 100", avifdecQuality)
+	}
+
+	if err = resolveDownloadBinaries(); err != nil {
+		log.Fatal(err)
+	}
+
+	// A semaphore of size 0 would block every job forever
+	if maxImageJobs == 0 {
+		log.Fatal("max_image_jobs must be greater than 0")
+	}
+	if maxVideoJobs == 0 {
+		log.Fatal("max_video_jobs must be greater than 0")
+	}
+	if maxDownloadJobs == 0 {
+		log.Fatal("max_download_jobs must be greater than 0")
+	}
+
+	if runAsFlag != "" {
+		if runAsGlobal, err = parseCommandUser(runAsFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if configFile == "" {
 		log.Fatal("the -tasks_file flag is required")
 	}
 
-	config, err = NewConfig(&configFile)
+	c, err := NewConfig(&configFile)
 	if err != nil {
 		log.Fatalf("error loading config file: %v", err)
 	}
+	if err = c.checkTaskBinaries(); err != nil {
+		log.Fatal(err)
+	}
+	config.Store(c)
+}
+
+// resolveDownloadBinaries a missing binary fails at startup instead of at the first download
+func resolveDownloadBinaries() error {
+	for _, conversion := range downloadConversions {
+		if !*conversion.enabled {
+			continue
+		}
+		purpose := "convert " + strings.Join(conversion.extensions, "/") + " on download"
+		if err := resolveDownloadBinary(conversion.binary, purpose); err != nil {
+			return err
+		}
+	}
+	if !isDownloadConversionEnabled() || downloadOrientation == "none" {
+		return nil
+	}
+	if err := resolveDownloadBinary("exiftool", "copy the orientation on download"); err != nil {
+		return err
+	}
+	if downloadOrientation == "bake" {
+		return resolveDownloadBinary("magick", "bake the orientation on download")
+	}
+	return nil
+}
+
+// resolveDownloadBinary finds the configured path of the binary, stored in resolvedDownloadBinaries
+func resolveDownloadBinary(binary, purpose string) error {
+	if _, ok := resolvedDownloadBinaries[binary]; ok {
+		return nil
+	}
+	name := binary
+	if configured, ok := downloadBinaryPaths[binary]; ok {
+		name = *configured
+	}
+	resolved, err := exec.LookPath(name)
+	if err == nil {
+		resolved, err = filepath.Abs(resolved)
+	}
+	if err != nil {
+		return fmt.Errorf("%s needed to %s: %w", binary, purpose, err)
+	}
+	resolvedDownloadBinaries[binary] = resolved
+	log.Printf("%s with %s", purpose, resolved)
+	return nil
 }
 
 func removeAllContents(dir string) error {
@@ -143,13 +412,123 @@ func removeAllContents(dir string) error {
 	})
 }
 
-func getHTTPclient() (client *http.Client) {
+// upstreamRootCAs nil uses the system CAs
+var upstreamRootCAs *x509.CertPool
+
+// loadUpstreamCAs the system CAs plus the ones in upstream_ca_file
+func loadUpstreamCAs(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+func upstreamTLSConfig() *tls.Config {
+	return &tls.Config{RootCAs: upstreamRootCAs, InsecureSkipVerify: upstreamInsecureSkipVerify}
+}
+
+// upstreamTransport shared by the proxy and the requests made by IUO, so connections to Immich are reused
+var upstreamTransport http.RoundTripper
+
+// newUpstreamTransport timeouts only cover connecting and waiting for the response, a long upload of a big video isn't cut
+func newUpstreamTransport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = upstreamResponseHeaderTimeout
+	transport.TLSClientConfig = upstreamTLSConfig()
 	if DevMITMproxy {
-		client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
-	} else {
-		client = &http.Client{}
+		transport.Proxy = http.ProxyURL(proxyUrl)
 	}
-	return
+	if len(upstreamHeaders.header) > 0 {
+		return headerTransport{transport, upstreamHeaders.header}
+	}
+	return transport
+}
+
+// headerTransport sets the -upstream_header headers on every request sent to Immich, replacing the ones sent by the client
+type headerTransport struct {
+	transport http.RoundTripper
+	header    http.Header
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it's given
+	req = req.Clone(req.Context())
+	for key, values := range t.header {
+		req.Header[key] = values
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// headerFlag repeatable "Name: Value" flag. Given on the command line, it replaces the values of the env variable
+type headerFlag struct {
+	header http.Header
+	set    bool
+}
+
+var upstreamHeaders headerFlag
+
+// setEnv IUO_UPSTREAM_HEADER holds one header per line
+func (f *headerFlag) setEnv(value string) error {
+	for _, line := range strings.Split(value, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := f.add(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *headerFlag) add(value string) error {
+	name, headerValue, ok := strings.Cut(value, ":")
+	name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid header, expected \"Name: Value\": %s", value)
+	}
+	switch name {
+	case "Content-Type", "Content-Length", "Transfer-Encoding":
+		// Set by IUO for the multipart body of the uploads
+		return fmt.Errorf("header %s can't be set", name)
+	}
+	if f.header == nil {
+		f.header = http.Header{}
+	}
+	f.header.Add(name, strings.TrimSpace(headerValue))
+	return nil
+}
+
+func (f *headerFlag) Set(value string) error {
+	if !f.set {
+		f.header, f.set = nil, true
+	}
+	return f.add(value)
+}
+
+func (f *headerFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var headers []string
+	for key, values := range f.header {
+		for _, value := range values {
+			headers = append(headers, key+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func getHTTPclient() *http.Client {
+	return &http.Client{Transport: upstreamTransport, Timeout: upstreamTimeout}
 }
 
 func setHeaders(h1, h2 http.Header) {
@@ -173,6 +552,44 @@ func webSocketSafeHeader(header http.Header) http.Header {
 	return header
 }
 
+// headTailBuffer keeps only the first and last limit/2 bytes written to it, limit 0 keeps everything
+type headTailBuffer struct {
+	limit int
+	head  []byte
+	tail  []byte
+	total int
+}
+
+func newHeadTailBuffer(limit int) *headTailBuffer {
+	return &headTailBuffer{limit: limit}
+}
+
+func (b *headTailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += n
+	if b.limit == 0 {
+		b.head = append(b.head, p...)
+		return n, nil
+	}
+	if room := b.limit/2 - len(b.head); room > 0 {
+		room = min(room, len(p))
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+	b.tail = append(b.tail, p...)
+	if keep := b.limit - b.limit/2; len(b.tail) > keep {
+		b.tail = b.tail[:copy(b.tail, b.tail[len(b.tail)-keep:])]
+	}
+	return n, nil
+}
+
+func (b *headTailBuffer) String() string {
+	if truncated := b.total - len(b.head) - len(b.tail); truncated > 0 {
+		return fmt.Sprintf("%s\n... [%d bytes truncated] ...\n%s", b.head, truncated, b.tail)
+	}
+	return string(b.head) + string(b.tail)
+}
+
 type nopWriteCloser struct {
 	io.Writer
 }
@@ -185,7 +602,12 @@ func NopWriteCloser(w io.Writer) io.WriteCloser {
 	return nopWriteCloser{w}
 }
 
-func getBodyWriterReaderHTTP(w *http.ResponseWriter, resp *http.Response) (bodyReader io.ReadCloser, bodyWriter io.WriteCloser) {
+// compressedEncodings the Content-Encodings getBodyWriterReaderHTTP decodes and encodes back
+var compressedEncodings = []string{"gzip", "br", "zstd"}
+
+// getBodyWriterReaderHTTP bodyReader decodes the body of resp, bodyWriter encodes what's written with the same Content-Encoding into w.
+// bodyWriter must be closed to flush the encoded body, it's nil when w is nil
+func getBodyWriterReaderHTTP(w io.Writer, resp *http.Response) (bodyReader io.ReadCloser, bodyWriter io.WriteCloser) {
 	var err error
 	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
@@ -193,19 +615,106 @@ func getBodyWriterReaderHTTP(w *http.ResponseWriter, resp *http.Response) (bodyR
 			break
 		}
 		if w != nil {
-			bodyWriter = gzip.NewWriter(*w)
+			bodyWriter = gzip.NewWriter(w)
 		}
 		return
 	case "br":
 		bodyReader = io.NopCloser(brotli.NewReader(resp.Body))
 		if w != nil {
-			bodyWriter = brotli.NewWriter(*w)
+			bodyWriter = brotli.NewWriter(w)
+		}
+		return
+	case "zstd":
+		var decoder *zstd.Decoder
+		if decoder, err = zstd.NewReader(resp.Body); err != nil {
+			break
+		}
+		bodyReader = decoder.IOReadCloser()
+		if w != nil {
+			// Close flushes the last frame
+			if bodyWriter, err = zstd.NewWriter(w); err != nil {
+				decoder.Close()
+				break
+			}
 		}
 		return
 	}
 	bodyReader = io.NopCloser(resp.Body)
 	if w != nil {
-		bodyWriter = NopWriteCloser(*w)
+		bodyWriter = NopWriteCloser(w)
 	}
 	return
 }
+
+// writeEncodedBody encodes body with bodyWriter into encoded, then sends it with the Content-Length of the encoded bytes.
+// The length of the body changes when it's modified, the one sent by the upstream is wrong
+func writeEncodedBody(w http.ResponseWriter, statusCode int, body []byte, bodyWriter io.WriteCloser, encoded *bytes.Buffer) error {
+	if statusCode == http.StatusNotModified || statusCode == http.StatusNoContent {
+		// No body allowed, not even an empty compressed one
+		w.Header().Del("Content-Length")
+		w.WriteHeader(statusCode)
+		return nil
+	}
+	if _, err := bodyWriter.Write(body); err != nil {
+		return err
+	}
+	if err := bodyWriter.Close(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(encoded.Len()))
+	w.WriteHeader(statusCode)
+	_, err := w.Write(encoded.Bytes())
+	return err
+}
+
+// uploadLimiter shared by all the uploads to Immich so their sum stays under upload_rate_limit, nil when unset
+var uploadLimiter *rate.Limiter
+
+// limitUploadRate ctx is the one of the client request, the wait ends when it's gone
+func limitUploadRate(ctx context.Context, reader io.Reader) io.Reader {
+	if uploadLimiter == nil {
+		return reader
+	}
+	return rateLimitedReader{ctx, reader, uploadLimiter}
+}
+
+// rateLimitedReader returns what it read only once the limiter allows it
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+func (r rateLimitedReader) Read(p []byte) (int, error) {
+	// WaitN fails for more than the burst
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// checkTempDir uploads are copied in dir, a read-only one would fail every job
+func checkTempDir(dir string) error {
+	probe, err := os.CreateTemp(dir, "probe-*")
+	if err != nil {
+		return fmt.Errorf("the tmp directory %s isn't writable, set TMPDIR to a folder writable by IUO: %w", dir, err)
+	}
+	_ = probe.Close()
+	_ = os.Remove(probe.Name())
+	if requireTmpfs {
+		tmpfs, err := isTmpfs(dir)
+		if err != nil {
+			return fmt.Errorf("require_tmpfs: %w", err)
+		}
+		if !tmpfs {
+			return fmt.Errorf("require_tmpfs: the tmp directory %s isn't a tmpfs, set TMPDIR to a tmpfs mount", dir)
+		}
+	}
+	return nil
+}
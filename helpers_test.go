@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/time/rate"
+)
+
+func TestValidateFilename(t *testing.T) {
+	defer func() { maxFilenameLength = 0 }()
+	long := strings.Repeat("a", 300) + ".jpg"
+	tests := []struct {
+		name      string
+		maxLength uint
+		wantErr   bool
+	}{
+		{"IMG 0001 (copy).jpg", 0, false},
+		{"it's \"quoted\".jpg", 0, false},
+		{"été 日本 🙂.heic", 0, false},
+		{"-starts-with-dash.jpg", 0, false},
+		{long, 0, false},
+		{long, 255, true},
+		{"a/b.jpg", 0, true},
+		{"a\\b.jpg", 0, true},
+		{"line\nbreak.jpg", 0, true},
+		{"\xff.jpg", 0, true},
+		{"..", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		maxFilenameLength = test.maxLength
+		if err := validateFilename(test.name); (err != nil) != test.wantErr {
+			t.Errorf("validateFilename(%q) with max %d = %v, want error %v", test.name, test.maxLength, err, test.wantErr)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	defer func() { maxFilenameLength = 0 }()
+	tests := []struct {
+		name      string
+		maxLength uint
+		want      string
+	}{
+		{"a/b\\c\n.jpg", 0, "a_b_c_.jpg"},
+		{"\xff.jpg", 0, "_.jpg"},
+		{"..", 0, "upload"},
+		{"abcdefgh.jpg", 8, "abcd.jpg"},
+		// A 2 byte character isn't cut in half
+		{"aéé.jpg", 6, "a.jpg"},
+		{"a.verylongextension", 8, "a.verylo"},
+	}
+	for _, test := range tests {
+		maxFilenameLength = test.maxLength
+		if got := sanitizeFilename(test.name); got != test.want {
+			t.Errorf("sanitizeFilename(%q) with max %d = %q, want %q", test.name, test.maxLength, got, test.want)
+		}
+		if err := validateFilename(sanitizeFilename(test.name)); err != nil {
+			t.Errorf("sanitized %q is invalid: %v", test.name, err)
+		}
+	}
+}
+
+func TestWriteEncodedBodyGzipLength(t *testing.T) {
+	payload := []byte(`{"checksum":"short"}`)
+	upstream := &http.Response{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: io.NopCloser(bytes.NewReader(gzipped(t, string(payload))))}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var encoded bytes.Buffer
+		bodyReader, bodyWriter := getBodyWriterReaderHTTP(&encoded, upstream)
+		defer bodyReader.Close()
+		body, err := io.ReadAll(bodyReader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// The length sent by the upstream, wrong once the body is modified
+		w.Header().Set("Content-Length", "10")
+		w.Header().Set("Content-Encoding", "gzip")
+		body = replaceAllBytes(body, []byte("short"), []byte("a much longer checksum"))
+		if err = writeEncodedBody(w, http.StatusOK, body, bodyWriter, &encoded); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	// Not decoded by the transport, the client checks the bytes it gets
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	compressed, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("client got a truncated body: %v", err)
+	}
+	if resp.ContentLength != int64(len(compressed)) {
+		t.Errorf("Content-Length %d, body of %d bytes", resp.ContentLength, len(compressed))
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"checksum":"a much longer checksum"}`; string(decoded) != want {
+		t.Errorf("client decodes %s, want %s", decoded, want)
+	}
+}
+
+// encodeBody body encoded like a response with the Content-Encoding encoding
+func encodeBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&encoded)
+	case "br":
+		writer = brotli.NewWriter(&encoded)
+	case "zstd":
+		var err error
+		if writer, err = zstd.NewWriter(&encoded); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		return body
+	}
+	if _, err := writer.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return encoded.Bytes()
+}
+
+func TestBodyWriterReaderRoundTrip(t *testing.T) {
+	// Big enough to span several compressed blocks, a writer not flushed on close truncates it
+	payload := bytes.Repeat([]byte(`{"checksum":"bmV3X2NoZWNrc3VtX2hhc2g=","name":"IMG_0001.avif"},`), 20000)
+	want := bytes.ReplaceAll(payload, []byte("bmV3X2NoZWNrc3VtX2hhc2g="), []byte("b3JpZ2luYWxfY2hlY2tzdW0="))
+	for _, encoding := range []string{"zstd", "gzip", "br", ""} {
+		name := encoding
+		if name == "" {
+			name = "identity"
+		}
+		t.Run(name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(encodeBody(t, encoding, payload)))}
+			if encoding != "" {
+				resp.Header.Set("Content-Encoding", encoding)
+			}
+			var encoded bytes.Buffer
+			bodyReader, bodyWriter := getBodyWriterReaderHTTP(&encoded, resp)
+			defer bodyReader.Close()
+			body, err := io.ReadAll(bodyReader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(body, payload) {
+				t.Fatalf("decoded %d bytes, want the %d bytes encoded", len(body), len(payload))
+			}
+			body = replaceAllBytes(body, []byte("bmV3X2NoZWNrc3VtX2hhc2g="), []byte("b3JpZ2luYWxfY2hlY2tzdW0="))
+
+			w := httptest.NewRecorder()
+			if err = writeEncodedBody(w, http.StatusOK, body, bodyWriter, &encoded); err != nil {
+				t.Fatal(err)
+			}
+			if contentLength := w.Header().Get("Content-Length"); contentLength != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length %s, body of %d bytes", contentLength, w.Body.Len())
+			}
+			decodedReader, _ := getBodyWriterReaderHTTP(nil, &http.Response{Header: resp.Header, Body: io.NopCloser(w.Body)})
+			defer decodedReader.Close()
+			decoded, err := io.ReadAll(decodedReader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, want) {
+				t.Errorf("client decodes %d bytes, want the %d bytes replaced", len(decoded), len(want))
+			}
+		})
+	}
+}
+
+func TestReplaceAllBytes(t *testing.T) {
+	tests := []struct {
+		name, body, old, new, want string
+	}{
+		{"equal", `{"checksum":"aaaa","other":"aaaa"}`, "aaaa", "bbbb", `{"checksum":"bbbb","other":"bbbb"}`},
+		{"shorter", `{"checksum":"aaaa","other":"aaaa"}`, "aaaa", "bb", `{"checksum":"bb","other":"bb"}`},
+		{"longer", `{"checksum":"aaaa","other":"aaaa"}`, "aaaa", "bbbbbb", `{"checksum":"bbbbbb","other":"bbbbbb"}`},
+		{"adjacent", "aaaaaaaa", "aaaa", "bbbb", "bbbbbbbb"},
+		{"no match", `{"checksum":"cccc"}`, "aaaa", "bbbbbb", `{"checksum":"cccc"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := replaceAllBytes([]byte(test.body), []byte(test.old), []byte(test.new)); string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitedReaderRate(t *testing.T) {
+	const rateLimit = 1 << 20
+	// Like upload_rate_limit sets it, in bytes per second with a burst of one second
+	previous := uploadLimiter
+	uploadLimiter = rate.NewLimiter(rate.Limit(rateLimit), rateLimit)
+	defer func() { uploadLimiter = previous }()
+	// Drains the burst, every byte read then waits for the rate
+	uploadLimiter.AllowN(time.Now(), rateLimit)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, limitUploadRate(context.Background(), bytes.NewReader(make([]byte, rateLimit/2))))
+	if err != nil || n != rateLimit/2 {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+	// 500ms at the rate, the upper bound is loose for slow machines
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("read half a second of rate in %s", elapsed)
+	}
+}
+
+func TestIsAllowedPath(t *testing.T) {
+	previous := allowedPaths
+	allowedPaths = []string{"/api/asset", "/_app/", "/.well-known/immich"}
+	defer func() { allowedPaths = previous }()
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/asset", true},
+		{"/api/asset/", true},
+		{"/api/asset/123/thumbnail", true},
+		{"/api/assets", false},
+		{"/api/assets-admin/x", false},
+		{"/api/asset/../users", false},
+		{"/_app", true},
+		{"/_app/immutable/a.js", true},
+		{"/_apps", false},
+		{"/.well-known/immich", true},
+		{"/.well-known/immich2", false},
+		{"/", false},
+	}
+	for _, test := range tests {
+		if got := isAllowedPath(test.path); got != test.want {
+			t.Errorf("isAllowedPath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestCheckTempDir(t *testing.T) {
+	if err := checkTempDir(t.TempDir()); err != nil {
+		t.Fatalf("writable dir: %v", err)
+	}
+	readOnly := t.TempDir()
+	if err := os.Chmod(readOnly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(readOnly, 0755)
+	if probe, err := os.CreateTemp(readOnly, "probe-*"); err == nil {
+		_ = probe.Close()
+		t.Skip("the permissions of the read-only dir don't apply, e.g. running as root")
+	}
+	err := checkTempDir(readOnly)
+	if err == nil || !strings.Contains(err.Error(), "isn't writable, set TMPDIR") {
+		t.Errorf("read-only dir: err = %v, want the TMPDIR advice", err)
+	}
+}
+
+func TestRateLimitedReaderCancelled(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Limit(1), 1024)
+	// Drains the burst, the next KB waits about 17 minutes
+	limiter.AllowN(time.Now(), 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := rateLimitedReader{ctx, bytes.NewReader(make([]byte, 4096)), limiter}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := io.Copy(io.Discard, reader)
+	if err == nil {
+		t.Fatal("read went on after the client was gone")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("blocked %s after the cancel", elapsed)
+	}
+}
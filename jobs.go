@@ -1,37 +1,271 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var jobIdCounter atomic.Int64
-var jobs sync.Map // map[string]int
+var jobs sync.Map // map[string]*runningJob
 
-func newJob(r *http.Request, w http.ResponseWriter, logger *customLogger) error {
+type jobPhase int32
+
+const (
+	phaseDownloading jobPhase = iota
+	phaseProcessing
+	phaseUploading
+)
+
+var jobPhaseNames = []string{"downloading", "processing", "uploading"}
+
+// runningJob value of the jobs map, listed by /iuo/jobs
+type runningJob struct {
+	id      int64
+	started time.Time
+	phase   atomic.Int32
+	// done closed when the job ends, after its response was sent
+	done chan struct{}
+	// response kept for the uploads of the same file waiting for the job, with duplicate_job wait
+	response *jobResponse
+}
+
+func (j *runningJob) setPhase(phase jobPhase) {
+	j.phase.Store(int32(phase))
+}
+
+// maxJobResponseSize a bigger response isn't kept, the waiting uploads process the file themselves
+const maxJobResponseSize = 1 << 20
+
+// jobResponse records the response sent to the client of a job while writing it
+type jobResponse struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+	// truncated the body was too big to be kept
+	truncated bool
+}
+
+func (jr *jobResponse) WriteHeader(status int) {
+	if jr.status == 0 {
+		jr.status = status
+		jr.header = jr.ResponseWriter.Header().Clone()
+	}
+	jr.ResponseWriter.WriteHeader(status)
+}
+
+func (jr *jobResponse) Write(p []byte) (int, error) {
+	if jr.status == 0 {
+		jr.WriteHeader(http.StatusOK)
+	}
+	if jr.body.Len()+len(p) > maxJobResponseSize {
+		jr.truncated = true
+	} else if !jr.truncated {
+		jr.body.Write(p)
+	}
+	return jr.ResponseWriter.Write(p)
+}
+
+// replay sends the recorded response, false if there is none to send (e.g. the client of the job disconnected)
+func (jr *jobResponse) replay(w http.ResponseWriter) bool {
+	if jr == nil || jr.status == 0 || jr.truncated {
+		return false
+	}
+	for key, values := range jr.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(jr.status)
+	_, _ = w.Write(jr.body.Bytes())
+	return true
+}
+
+// activeJobs jobs still running, shutdown waits for them even if their client disconnected
+var activeJobs sync.WaitGroup
+var shutdownLock sync.Mutex
+var shuttingDown bool
+
+// startJob false once shutting down, otherwise activeJobs.Done() must be called when the job ends
+func startJob() bool {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	if shuttingDown {
+		return false
+	}
+	activeJobs.Add(1)
+	return true
+}
+
+// waitJobs stops accepting new jobs and waits for the running ones until ctx is done
+func waitJobs(ctx context.Context) error {
+	shutdownLock.Lock()
+	shuttingDown = true
+	shutdownLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		activeJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var imageJobsQueued atomic.Int64
+var videoJobsQueued atomic.Int64
+
+// errQueueFull max_queued_jobs jobs are already waiting for a slot
+var errQueueFull = errors.New("job queue is full")
+
+// queueFullRetryAfter seconds the client is asked to wait before uploading again when the queue is full
+const queueFullRetryAfter = 30
+
+// acquireJobSlot waits for a free slot of semaphore, queued counts the jobs waiting for it
+func acquireJobSlot(ctx context.Context, semaphore chan struct{}, queued *atomic.Int64) error {
+	select {
+	case semaphore <- struct{}{}:
+		return nil
+	default:
+	}
+	if n := queued.Add(1); maxQueuedJobs > 0 && n > int64(maxQueuedJobs) {
+		queued.Add(-1)
+		return errQueueFull
+	}
+	defer queued.Add(-1)
+	select {
+	case semaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("cancelled while waiting for a free job slot: %w", ctx.Err())
+	}
+}
+
+// rejectQueueFull the client retries later instead of piling up more uploads in memory
+func rejectQueueFull(w http.ResponseWriter) error {
+	w.Header().Set("Retry-After", strconv.Itoa(queueFullRetryAfter))
+	http.Error(w, "IUO is busy, retry later", http.StatusServiceUnavailable)
+	return errors.New("job queue is full, upload refused")
+}
+
+// uploadJobKey the key of the upload in jobs: the same content uploaded again is the same job, no matter its name.
+// The name and size are the fallback without checksum
+func uploadJobKey(r *http.Request, header *multipart.FileHeader, clientChecksum string) string {
+	key := fmt.Sprintf("\"%s\" (%s)", header.Filename, humanReadableSize(header.Size))
+	if clientChecksum != "" {
+		key = "checksum " + clientChecksum
+	}
+	// Only uploads of the same requester are the same job, another user must get their own asset
+	if _, credentials := requestCredentials(r); credentials != "" {
+		key += " from " + credentials[:16]
+	}
+	return key
+}
+
+func newJob(r *http.Request, w http.ResponseWriter, logger *customLogger) (err error) {
+	if !startJob() {
+		http.Error(w, "IUO is shutting down", http.StatusServiceUnavailable)
+		return errors.New("shutting down, upload refused")
+	}
+	defer activeJobs.Done()
 	jobID := jobIdCounter.Add(1)
-	jobLogger := newCustomLogger(logger, fmt.Sprintf("job %d: ", jobID))
+	jobLogger := newCustomLogger(logger, fmt.Sprintf("job %d: ", jobID)).WithField("job", jobID)
+	// Registered first so it runs last: the deferred cleanups of the job have already removed its temp files
+	defer func() {
+		if p := recover(); p != nil {
+			http.Error(w, "failed to process file, view IUO logs for more info", http.StatusInternalServerError)
+			err = fmt.Errorf("job %d panicked: %v\n%s", jobID, p, debug.Stack())
+		}
+	}()
 
 	formFile, formFileHeader, err := r.FormFile(filterFormKey)
+	if errors.Is(err, http.ErrMissingFile) && r.MultipartForm != nil {
+		jobLogger.Warnf("no file in form key %s, forwarding the upload unmodified", filterFormKey)
+		return forwardForm(w, r)
+	}
 	if err != nil {
+		http.Error(w, "invalid upload form data", http.StatusBadRequest)
 		return fmt.Errorf("unable to read file in key %s from uploaded form data: %w", filterFormKey, err)
 	}
 	defer r.MultipartForm.RemoveAll()
 	defer formFile.Close()
 
-	jobKey := fmt.Sprintf("\"%s\" (%s)", formFileHeader.Filename, humanReadableSize(formFileHeader.Size))
-	jobLogger.Printf("download original: %s", jobKey)
-	if id, exists := jobs.Load(jobKey); exists {
+	// Immich names the asset after the filename field when sent, not the file part. Both get the name of the uploaded file,
+	// which must be derived from the one Immich would display. deviceAssetId is left alone: clients use it to track what they uploaded
+	if filename := r.MultipartForm.Value["filename"]; len(filename) > 0 && filename[0] != "" && filename[0] != formFileHeader.Filename {
+		jobLogger.Debugf("filename field \"%s\" differs from the file name \"%s\", using the field", filename[0], formFileHeader.Filename)
+		formFileHeader.Filename = filename[0]
+	}
+	if err = validateFilename(formFileHeader.Filename); err != nil {
+		if !sanitizeFilenames {
+			http.Error(w, "invalid filename", http.StatusBadRequest)
+			return err
+		}
+		sanitized := sanitizeFilename(formFileHeader.Filename)
+		jobLogger.Warnf("%v: sanitized to \"%s\"", err, sanitized)
+		formFileHeader.Filename = sanitized
+	}
+
+	jobLogger.Debugf("download original: \"%s\" (%s)", formFileHeader.Filename, humanReadableSize(formFileHeader.Size))
+	clientChecksum, _ := uploadChecksum(r)
+	jobKey := uploadJobKey(r, formFileHeader, clientChecksum)
+	job := &runningJob{id: jobID, started: time.Now(), done: make(chan struct{})}
+	if duplicateJob == "wait" {
+		job.response = &jobResponse{ResponseWriter: w}
+	}
+	for {
+		value, exists := jobs.LoadOrStore(jobKey, job)
+		if !exists {
+			break
+		}
+		existing := value.(*runningJob)
+		switch duplicateJob {
+		case "wait":
+			jobLogger.Infof("job %d is already processing this file, waiting for it", existing.id)
+			select {
+			case <-existing.done:
+			case <-r.Context().Done():
+				return fmt.Errorf("client disconnected while waiting for job %d", existing.id)
+			}
+			if existing.response.replay(w) {
+				jobLogger.Infof("answered with the response of job %d", existing.id)
+				return nil
+			}
+			// Nothing to share, this upload processes the file unless another one took over first
+			continue
+		case "accept":
+			w.WriteHeader(http.StatusAccepted)
+			jobLogger.Infof("job %d is already processing this file, accepted", existing.id)
+			return nil
+		}
 		http.Error(w, "IUO is already processing this file. The app is re-uploading it because it's taking too long. No workaround is possible, just kill the app and wait", http.StatusInternalServerError)
-		return fmt.Errorf("a job processing this file already exists with ID: %d", id)
+		return fmt.Errorf("a job processing this file already exists with ID: %d", existing.id)
+	}
+	if job.response != nil {
+		w = job.response
 	}
-	jobs.Store(jobKey, jobID)
-	defer jobs.Delete(jobKey)
+	// The waiting uploads are woken once the job is gone from the map, they can take it over
+	defer func() {
+		jobs.Delete(jobKey)
+		close(job.done)
+	}()
+	persistJobStart(jobKey, jobID)
+	defer persistJobEnd(jobKey)
 
 	var originalHash string
 	var newHash string
@@ -39,124 +273,520 @@ func newJob(r *http.Request, w http.ResponseWriter, logger *customLogger) error
 	uploadFilename := formFileHeader.Filename
 	uploadOriginal := true
 
-	taskProcessor, err := NewTaskProcessorFromMultipart(formFile, formFileHeader)
-	if err == nil && taskProcessor != nil {
+	var taskProcessor *TaskProcessor
+	if beforeCutoff, createdAt := isCreatedBeforeCutoff(r.MultipartForm.Value); beforeCutoff {
+		jobLogger.Debugf("created before optimize_after (%s), skipping", createdAt.Format(time.RFC3339))
+	} else if skipLivePhotos && isLivePhotoUpload(r.MultipartForm.Value) {
+		jobLogger.Debugf("part of a live photo, skipping")
+	} else if reason := config.Load().excludedUpload(r, jobLogger); reason != "" {
+		jobLogger.Debugf("%s, skipping", reason)
+	} else if taskProcessor, err = NewTaskProcessorFromMultipart(r.Context(), formFile, formFileHeader, declaredFileSize(r.MultipartForm.Value), clientChecksum); err != nil {
+		// The original is uploaded as received: Immich rejects a corrupt one, the client uploads it again
+		if errors.Is(err, errNotEnoughSpace) || errors.Is(err, errCorruptUpload) {
+			jobLogger.Warnf("%v, uploading original", err)
+		}
+		taskProcessor = nil
+	}
+	respHeader := http.Header{}
+	if taskHeader || resultHeaders {
+		taskName := "none"
+		if taskProcessor != nil {
+			taskName = taskProcessor.Task.Name
+		}
+		respHeader.Set("X-IUO-Task", taskName)
+	}
+	if taskProcessor != nil {
 		defer taskProcessor.Close()
+		persistJobTempFile(jobKey, taskProcessor.tempOriginalFilePath)
+		taskProcessor.JobID = jobID
+		jobLogger = jobLogger.WithField("task", taskProcessor.Task.Name)
 		taskProcessor.SetLogger(jobLogger)
 		// Delete multipart file before running command. Saves RAM (tmpfs)
 		_ = formFile.Close()
 		_ = r.MultipartForm.RemoveAll()
-		if err = taskProcessor.Run(); err != nil {
-			return fmt.Errorf("failed to process file in job %d: %v", jobID, err.Error())
-		}
-		if taskProcessor.OriginalSize <= taskProcessor.ProcessedSize {
+		job.setPhase(phaseProcessing)
+		if taskProcessor.Task.StreamUpload {
+			resp, newHash, err := taskProcessor.RunStreamed(r.Context(), func(stream io.ReadSeeker, name string) (*http.Response, error) {
+				return postUpstream(r, stream, name, jobLogger)
+			})
+			if err == nil {
+				return finishStreamedJob(w, r, resp, respHeader, taskProcessor, newHash, clientChecksum, jobLogger)
+			}
+			if r.Context().Err() != nil {
+				return fmt.Errorf("client disconnected, upload skipped: %w", err)
+			}
+			if errors.Is(err, errQueueFull) {
+				return rejectQueueFull(w)
+			}
+			jobLogger.Warnf("streamed upload failed, uploading original: %v", err)
 			uploadFile = taskProcessor.OriginalFile
-			_ = taskProcessor.CleanWorkDir() // Save RAM before upload (tmpfs)
 		} else {
-			uploadFile = taskProcessor.ProcessedFile
-			uploadFilename = taskProcessor.ProcessedFilename
-			uploadOriginal = false
-			if originalHash, err = SHA1(taskProcessor.OriginalFile); err != nil {
-				return fmt.Errorf("sha1: %w", err)
+			if err = taskProcessor.Run(r.Context()); r.Context().Err() != nil {
+				// Nobody is left to receive the response, the deferred cleanup removes the temp files
+				return fmt.Errorf("client disconnected, upload skipped: %v", err)
+			} else if errors.Is(err, errQueueFull) {
+				return rejectQueueFull(w)
+			} else if err != nil {
+				jobLogger.Warnf("failed to process file, uploading original: %v", err)
+				uploadFile = taskProcessor.OriginalFile
+				_ = taskProcessor.CleanWorkDir()
+			} else if !taskProcessor.KeepPolicy.keepProcessed(taskProcessor.OriginalSize, taskProcessor.ProcessedSize) {
+				uploadFile = taskProcessor.OriginalFile
+				_ = taskProcessor.CleanWorkDir() // Save RAM before upload (tmpfs)
+			} else if originalHash, err = originalSHA1(clientChecksum, taskProcessor, jobLogger); err != nil {
+				// Without it the replacer can't map the processed file back to the original
+				jobLogger.Warnf("unable to hash original, uploading it: %v", err)
+				uploadFile = taskProcessor.OriginalFile
+				_ = taskProcessor.CleanWorkDir()
+			} else {
+				uploadFile = taskProcessor.ProcessedFile
+				uploadFilename = taskProcessor.ProcessedFilename
+				uploadOriginal = false
+				if !taskProcessor.Task.keepOriginal() {
+					_ = taskProcessor.CleanOriginalFile() // Save RAM before upload (tmpfs)
+				}
 			}
-			_ = taskProcessor.CleanOriginalFile() // Save RAM before upload (tmpfs)
+		}
+	}
+	var rewrite func(Asset)
+	if restoreUploadResponse && !uploadOriginal {
+		rewrite = func(asset Asset) { asset.restoreOriginal(taskProcessor.OriginalFilename, originalHash) }
+	}
+	if resultHeaders {
+		if uploadOriginal {
+			setResultHeaders(respHeader, false, formFileHeader.Size, formFileHeader.Size)
+		} else {
+			setResultHeaders(respHeader, true, taskProcessor.OriginalSize, taskProcessor.ProcessedSize)
 		}
 	}
 	// Upload the original file or processed one if a task was found
-	err = uploadUpstream(w, r, uploadFile, uploadFilename)
-	if err != nil {
-		jobLogger.Printf("upload upstream error: %s", err.Error())
+	job.setPhase(phaseUploading)
+	duplicate, err := uploadUpstream(w, r, uploadFile, uploadFilename, respHeader, rewrite, jobLogger)
+	if uploadOriginal {
+		observeUpload(taskProcessor, false, formFileHeader.Size, err)
+	} else {
+		observeUpload(taskProcessor, true, taskProcessor.ProcessedSize, err)
+	}
+	if errors.Is(err, errUpstreamDisconnected) {
+		// Immich never answered, nothing was sent to the client yet
+		http.Error(w, "immich is unreachable, view IUO logs for more info", http.StatusBadGateway)
+		return fmt.Errorf("upload upstream error: %w", err)
+	} else if err != nil {
+		// The only error reaching the client, anything going wrong before falls back to uploading the original
 		http.Error(w, "failed to process file, view IUO logs for more info", http.StatusInternalServerError)
+		return fmt.Errorf("upload upstream error: %w", err)
 	}
-	if uploadOriginal {
-		jobLogger.Printf("uploaded original: \"%s\" (%s)", formFileHeader.Filename, humanReadableSize(formFileHeader.Size))
+	if duplicate {
+		// The asset already exists, its checksum mapping too if it was processed
+		if uploadOriginal {
+			jobLogger.Infof("duplicate: immich already has the original \"%s\" (%s)", formFileHeader.Filename, humanReadableSize(formFileHeader.Size))
+		} else {
+			jobLogger.Infof("duplicate: immich already has the processed \"%s\" (%s), the processing was wasted", taskProcessor.ProcessedFilename, humanReadableSize(taskProcessor.ProcessedSize))
+		}
+	} else if uploadOriginal {
+		jobLogger.Infof("uploaded original: \"%s\" (%s)", formFileHeader.Filename, humanReadableSize(formFileHeader.Size))
+		payload := webhookPayload{JobID: jobID, Filename: formFileHeader.Filename, UploadedFilename: uploadFilename, OriginalSize: formFileHeader.Size, ProcessedSize: formFileHeader.Size}
+		if taskProcessor != nil {
+			payload.Task = taskProcessor.Task.Name
+		}
+		notifyWebhook(payload, jobLogger)
 	} else {
 		if newHash, err = SHA1(taskProcessor.ProcessedFile); err != nil {
-			return fmt.Errorf("new sha1: %w", err)
+			jobLogger.Warnf("unable to hash processed file, its checksum won't be replaced: %v", err)
+		} else if newHash != originalHash {
+			// A no-op task creating a byte-identical output (kept by always_replace) must not be mapped
+			addChecksums(newHash, originalHash)
+		}
+		jobLogger.Infof("uploaded: \"%s\" (%s) <- (%s) \"%s\"", taskProcessor.ProcessedFilename, humanReadableSize(taskProcessor.ProcessedSize), humanReadableSize(taskProcessor.OriginalSize), taskProcessor.OriginalFilename)
+		notifyWebhook(optimizedPayload(taskProcessor), jobLogger)
+		startPostCommand(taskProcessor, originalHash, newHash)
+		// A byte-identical output is already the original
+		if taskProcessor.Task.keepOriginal() && newHash != originalHash {
+			uploadOriginalCopy(r, taskProcessor, jobLogger)
+		}
+	}
+
+	return nil
+}
+
+// uploadOriginalCopy keep_original: the untouched original is uploaded as a separate asset after the processed one.
+// Its own checksum isn't mapped, Immich stores it with the real checksum of the original
+func uploadOriginalCopy(r *http.Request, taskProcessor *TaskProcessor, logger *customLogger) {
+	if isAssetReplace(r) {
+		// Sent to the same asset, the copy would replace the processed file
+		logger.Debugf("keep_original isn't applied to the replacement of an asset")
+		return
+	}
+	values := make(map[string][]string, len(r.MultipartForm.Value))
+	for key, value := range r.MultipartForm.Value {
+		values[key] = value
+	}
+	// The device asset ID identifies the processed asset, the copy needs its own
+	if ids := values["deviceAssetId"]; len(ids) > 0 {
+		values["deviceAssetId"] = []string{ids[0] + keepOriginalSuffix}
+	}
+	// The client may already be gone, the copy is uploaded anyway
+	copyRequest := r.Clone(context.WithoutCancel(r.Context()))
+	copyRequest.MultipartForm = &multipart.Form{Value: values}
+	extension := path.Ext(taskProcessor.OriginalFilename)
+	name := strings.TrimSuffix(taskProcessor.OriginalFilename, extension) + keepOriginalSuffix + extension
+	resp, err := postUpstream(copyRequest, taskProcessor.OriginalFile, name, logger)
+	if err != nil {
+		logger.Warnf("unable to upload original copy \"%s\": %v", name, err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		logger.Warnf("unable to upload original copy \"%s\": %s", name, resp.Status)
+		return
+	}
+	logger.Infof("uploaded original copy: \"%s\" (%s)", name, humanReadableSize(taskProcessor.OriginalSize))
+}
+
+// finishStreamedJob the processed file has already been sent while the task was running, the size isn't compared: it's always kept
+func finishStreamedJob(w http.ResponseWriter, r *http.Request, resp *http.Response, respHeader http.Header, taskProcessor *TaskProcessor, newHash, clientChecksum string, jobLogger *customLogger) error {
+	// Already uploaded, a hashing error only prevents the checksum mapping
+	originalHash, hashErr := originalSHA1(clientChecksum, taskProcessor, jobLogger)
+	if resultHeaders {
+		setResultHeaders(respHeader, true, taskProcessor.OriginalSize, taskProcessor.ProcessedSize)
+	}
+	var rewrite func(Asset)
+	if restoreUploadResponse && hashErr == nil {
+		rewrite = func(asset Asset) { asset.restoreOriginal(taskProcessor.OriginalFilename, originalHash) }
+	}
+	duplicate := isDuplicateUpload(resp)
+	err := forwardResponse(w, resp, respHeader, rewrite)
+	observeUpload(taskProcessor, true, taskProcessor.ProcessedSize, err)
+	if err != nil {
+		jobLogger.Warnf("upload upstream error: %s", err.Error())
+	}
+	if duplicate {
+		jobLogger.Infof("duplicate (streamed): immich already has the processed \"%s\", the processing was wasted", taskProcessor.ProcessedFilename)
+		return nil
+	}
+	if hashErr != nil {
+		jobLogger.Warnf("uploaded (streamed): \"%s\", unable to hash original, its checksum won't be replaced: %v", taskProcessor.ProcessedFilename, hashErr)
+		notifyWebhook(optimizedPayload(taskProcessor), jobLogger)
+		startPostCommand(taskProcessor, "", newHash)
+		return nil
+	}
+	if newHash == originalHash {
+		// No-op task, nothing for the replacer to map
+		jobLogger.Infof("uploaded (streamed): \"%s\" identical to the original \"%s\"", taskProcessor.ProcessedFilename, taskProcessor.OriginalFilename)
+		notifyWebhook(optimizedPayload(taskProcessor), jobLogger)
+		startPostCommand(taskProcessor, originalHash, newHash)
+		return nil
+	}
+	addChecksums(newHash, originalHash)
+	jobLogger.Infof("uploaded (streamed): \"%s\" (%s) <- (%s) \"%s\"", taskProcessor.ProcessedFilename, humanReadableSize(taskProcessor.ProcessedSize), humanReadableSize(taskProcessor.OriginalSize), taskProcessor.OriginalFilename)
+	notifyWebhook(optimizedPayload(taskProcessor), jobLogger)
+	startPostCommand(taskProcessor, originalHash, newHash)
+	if taskProcessor.Task.keepOriginal() {
+		uploadOriginalCopy(r, taskProcessor, jobLogger)
+	}
+	return nil
+}
+
+// startPostCommand runs the task post_command in the background, the response to the client doesn't wait for it
+func startPostCommand(taskProcessor *TaskProcessor, originalHash, processedHash string) {
+	if taskProcessor.Task.PostCommandTemplate == nil {
+		return
+	}
+	// Shutdown waits for it like for the job that started it
+	activeJobs.Add(1)
+	go func() {
+		defer activeJobs.Done()
+		taskProcessor.RunPostCommand(context.Background(), originalHash, processedHash)
+	}()
+}
+
+// setResultHeaders result_headers: what IUO did with the upload, sent to the client after the upstream headers
+func setResultHeaders(header http.Header, optimized bool, originalSize, processedSize int64) {
+	action := "passthrough"
+	if optimized {
+		action = "optimized"
+	}
+	header.Set("X-IUO-Action", action)
+	header.Set("X-IUO-Original-Size", strconv.FormatInt(originalSize, 10))
+	header.Set("X-IUO-Processed-Size", strconv.FormatInt(processedSize, 10))
+}
+
+// originalSHA1 the checksum sent by the client saves a pass over the original, computed only if it's missing or malformed
+func originalSHA1(clientChecksum string, taskProcessor *TaskProcessor, logger *customLogger) (string, error) {
+	if clientChecksum != "" {
+		logger.Debugf("original sha1 from x-immich-checksum")
+		return clientChecksum, nil
+	}
+	logger.Debugf("no valid x-immich-checksum, computing original sha1")
+	return SHA1(taskProcessor.OriginalFile)
+}
+
+// maxUploadResponse bigger upload responses aren't an asset, they're forwarded without being checked for a duplicate
+const maxUploadResponse = 1 << 20
+
+// isDuplicateUpload immich answers with status "duplicate" in the JSON body when it already has an asset with the same checksum.
+// A 200 alone isn't enough: replacing an original also answers 200, with status "replaced".
+// The body is read and put back untouched for forwarding
+func isDuplicateUpload(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return false
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxUploadResponse+1))
+	resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(raw), resp.Body), Closer: resp.Body}
+	if err != nil || len(raw) > maxUploadResponse {
+		return false
+	}
+	bodyReader, _ := getBodyWriterReaderHTTP(nil, &http.Response{Header: resp.Header, Body: io.NopCloser(bytes.NewReader(raw))})
+	defer bodyReader.Close()
+	var upload struct {
+		Status string `json:"status"`
+	}
+	return json.NewDecoder(bodyReader).Decode(&upload) == nil && upload.Status == "duplicate"
+}
+
+// readCloser reads from Reader and closes Closer, e.g. a body partly read in advance
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// uploadUpstream respHeader: additional headers sent to the client along with the upstream response
+// rewrite: optional, modifies the asset in a JSON upload response
+// duplicate: immich didn't store the file, it already had it
+func uploadUpstream(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, name string, respHeader http.Header, rewrite func(Asset), logger *customLogger) (duplicate bool, err error) {
+	var resp *http.Response
+	for attempt := uint(1); ; attempt++ {
+		resp, err = postUpstream(r, file, name, logger)
+		if err == nil || !errors.Is(err, errUpstreamDisconnected) || attempt > uploadRetries {
+			break
 		}
-		addChecksums(newHash, originalHash)
-		jobLogger.Printf("uploaded: \"%s\" (%s) <- (%s) \"%s\"", taskProcessor.ProcessedFilename, humanReadableSize(taskProcessor.ProcessedSize), humanReadableSize(taskProcessor.OriginalSize), taskProcessor.OriginalFilename)
+		logger.Warnf("upload attempt %d failed, retrying: %v", attempt, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	duplicate = isDuplicateUpload(resp)
+	return duplicate, forwardResponse(w, resp, respHeader, rewrite)
+}
+
+// forwardResponse sends the immich response back to the client
+func forwardResponse(w http.ResponseWriter, resp *http.Response, respHeader http.Header, rewrite func(Asset)) (err error) {
+	defer resp.Body.Close()
+	if rewrite != nil && resp.StatusCode < 300 && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return forwardRewrittenResponse(w, resp, respHeader, rewrite)
 	}
+	setHeaders(w.Header(), resp.Header)
+	for key, values := range respHeader {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("unable to forward response to client: %v", err)
+	}
+	return nil
+}
 
+// forwardRewrittenResponse decodes the JSON asset in the response, modifies it and encodes it back with the same Content-Encoding
+func forwardRewrittenResponse(w http.ResponseWriter, resp *http.Response, respHeader http.Header, rewrite func(Asset)) error {
+	var encoded bytes.Buffer
+	bodyReader, bodyWriter := getBodyWriterReaderHTTP(&encoded, resp)
+	defer bodyWriter.Close()
+	defer bodyReader.Close()
+	jsonBuf, err := io.ReadAll(bodyReader)
+	if err != nil {
+		return fmt.Errorf("unable to read upstream response: %w", err)
+	}
+	var asset Asset
+	if err = json.Unmarshal(jsonBuf, &asset); err == nil {
+		rewrite(asset)
+		if jsonBuf, err = json.Marshal(asset); err != nil {
+			return fmt.Errorf("unable to encode upstream response: %w", err)
+		}
+	}
+	setHeaders(w.Header(), resp.Header)
+	for key, values := range respHeader {
+		w.Header()[key] = values
+	}
+	if err = writeEncodedBody(w, resp.StatusCode, jsonBuf, bodyWriter, &encoded); err != nil {
+		return fmt.Errorf("unable to forward response to client: %v", err)
+	}
 	return nil
 }
 
-func uploadUpstream(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, name string) (err error) {
+var errUpstreamDisconnected = errors.New("upstream closed the connection")
+
+// postUpstream sends the multipart form to the upstream, replacing the uploaded file with the given one
+func postUpstream(r *http.Request, file io.ReadSeeker, name string, logger *customLogger) (*http.Response, error) {
+	// Prepare chunked request, this saves A LOT of RAM compared to building the whole buffer in RAM.
 	pipeReader, pipeWriter := io.Pipe()
 	multipartWriter := multipart.NewWriter(pipeWriter)
+	// Buffered: the writer must never block on it, even if nobody is left to receive
 	errChan := make(chan error, 1)
-	defer close(errChan)
-	// Prepare chunked request, this saves A LOT of RAM compared to building the whole buffer in RAM.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	go func() {
-		defer pipeWriter.Close()
-		defer multipartWriter.Close()
-		for key, values := range r.MultipartForm.Value {
-			for _, value := range values {
-				if key == "filename" {
-					value = name
-				}
-				err = multipartWriter.WriteField(key, value)
-				if err != nil {
-					cancel()
-					errChan <- fmt.Errorf("unable to create form data: %w", err)
-					return
-				}
-			}
-		}
-		part, err := multipartWriter.CreateFormFile(filterFormKey, name)
-		if err != nil {
-			cancel()
-			errChan <- fmt.Errorf("unable to create form data: %w", err)
-			return
-		}
-		_, err = file.Seek(0, io.SeekStart)
-		if err != nil {
-			cancel()
-			errChan <- fmt.Errorf("unable to seek beginning of file: %w", err)
-			return
-		}
-		_, err = io.Copy(part, file)
-		if err != nil {
-			cancel()
-			errChan <- fmt.Errorf("unable to write file in form field: %w", err)
-			return
-		}
-		err = multipartWriter.Close()
-		if err != nil {
-			cancel()
-			errChan <- fmt.Errorf("unable to finish form data: %w", err)
-			return
-		}
-		errChan <- nil
+		err := writeMultipartForm(r.Context(), multipartWriter, r.MultipartForm.Value, file, name)
+		// Reader gets EOF on success or the error otherwise, making the request fail instead of hanging
+		_ = pipeWriter.CloseWithError(err)
+		errChan <- err
 	}()
-	req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL+r.URL.String(), pipeReader)
+	req, err := http.NewRequest(r.Method, upstreamURL+r.URL.String(), pipeReader)
 	if err != nil {
-		return fmt.Errorf("unable to create POST request: %w", err)
+		_ = pipeReader.CloseWithError(err)
+		<-errChan
+		return nil, fmt.Errorf("unable to create %s request: %w", r.Method, err)
 	}
-	req.Header = r.Header
+	req.Header = r.Header.Clone()
 	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	var dumpFile *os.File
+	if dumpUpstreamDir != "" && (dumpUpstreamAll || req.Header.Get(dumpHeader) != "") {
+		req.Header.Del(dumpHeader)
+		if dumpFile, err = dumpRequest(req, pipeReader); err != nil {
+			logger.Warnf("unable to dump upstream request: %v", err)
+		} else {
+			logger.Debugf("dumping upstream request: %s", dumpFile.Name())
+		}
+	}
 	// Send the request to the upstream server
 	resp, err := getHTTPclient().Do(req)
-	defer resp.Body.Close()
 	if err != nil {
-		select {
-		case chErr := <-errChan:
-			if err != nil {
-				return fmt.Errorf("error writing data to pipe: %v: %v", err, chErr)
+		if dumpFile != nil {
+			_ = dumpFile.Close()
+		}
+		// The writer may still be blocked on the pipe if upstream went away mid-upload
+		_ = pipeReader.CloseWithError(err)
+		if werr := <-errChan; werr != nil && !errors.Is(werr, err) && !errors.Is(werr, io.ErrClosedPipe) {
+			return nil, fmt.Errorf("error writing data to pipe: %w", werr)
+		}
+		return nil, fmt.Errorf("%w: unable to %s: %v", errUpstreamDisconnected, r.Method, err)
+	}
+	resp.Body = pipedResponseBody{resp.Body, pipeReader, dumpFile}
+	return resp, nil
+}
+
+const dumpHeader = "X-IUO-Dump"
+
+// dumpRequest writes the request line and headers to a new file in dump_upstream_dir and streams the body into it while it's sent.
+// Doesn't buffer the body, the file is complete once the request has been sent
+func dumpRequest(req *http.Request, body *io.PipeReader) (*os.File, error) {
+	dumpFile, err := os.CreateTemp(dumpUpstreamDir, "upload-*.http")
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(dumpFile, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	if err == nil {
+		// The client Content-Length doesn't apply, the body is sent chunked
+		err = req.Header.WriteSubset(dumpFile, map[string]bool{"Content-Length": true})
+	}
+	if err == nil {
+		_, err = io.WriteString(dumpFile, "\r\n")
+	}
+	if err != nil {
+		_ = dumpFile.Close()
+		return nil, err
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, dumpFile), body}
+	return dumpFile, nil
+}
+
+// pipedResponseBody also stops the multipart writer when upstream answered without reading the whole upload and closes the dump file
+type pipedResponseBody struct {
+	io.ReadCloser
+	pipeReader *io.PipeReader
+	dumpFile   *os.File
+}
+
+func (b pipedResponseBody) Close() error {
+	_ = b.pipeReader.Close()
+	if b.dumpFile != nil {
+		_ = b.dumpFile.Close()
+	}
+	return b.ReadCloser.Close()
+}
+
+// forwardForm proxies an upload IUO can't process, its body has already been parsed so the form is encoded again
+func forwardForm(w http.ResponseWriter, r *http.Request) error {
+	defer r.MultipartForm.RemoveAll()
+	pipeReader, pipeWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(pipeWriter)
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		_ = pipeWriter.CloseWithError(writeForm(r.Context(), multipartWriter, r.MultipartForm))
+	}()
+	r.Body = pipeReader
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	r.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	r.Host = remote.Host
+	proxy.ServeHTTP(w, r)
+	// Unblocks the writer if the proxy gave up before reading the whole body
+	_ = pipeReader.Close()
+	<-writeDone
+	return nil
+}
+
+// writeForm every value and file of form, as received
+func writeForm(ctx context.Context, multipartWriter *multipart.Writer, form *multipart.Form) error {
+	for key, values := range form.Value {
+		for _, value := range values {
+			if err := multipartWriter.WriteField(key, value); err != nil {
+				return fmt.Errorf("unable to create form data: %w", err)
 			}
-		default:
 		}
-		return fmt.Errorf("unable to POST: %w", err)
 	}
-	// Send immich response back to client
-	setHeaders(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	for _, fileHeaders := range form.File {
+		for _, fileHeader := range fileHeaders {
+			if err := writeFormFile(ctx, multipartWriter, fileHeader); err != nil {
+				return err
+			}
+		}
+	}
+	return multipartWriter.Close()
+}
+
+func writeFormFile(ctx context.Context, multipartWriter *multipart.Writer, fileHeader *multipart.FileHeader) error {
+	file, err := fileHeader.Open()
 	if err != nil {
-		return fmt.Errorf("unable to forward response to client: %v", err)
+		return fmt.Errorf("unable to open form file: %w", err)
+	}
+	defer file.Close()
+	part, err := multipartWriter.CreatePart(fileHeader.Header)
+	if err != nil {
+		return fmt.Errorf("unable to create form data: %w", err)
+	}
+	if _, err = io.Copy(part, limitUploadRate(ctx, file)); err != nil {
+		return fmt.Errorf("unable to write file in form field: %w", err)
 	}
+	return nil
+}
 
+// writeMultipartForm the file part and the filename field, if sent by the client, both get name
+func writeMultipartForm(ctx context.Context, multipartWriter *multipart.Writer, formValues map[string][]string, file io.ReadSeeker, name string) error {
+	for key, values := range formValues {
+		for _, value := range values {
+			if key == "filename" {
+				value = name
+			}
+			if err := multipartWriter.WriteField(key, value); err != nil {
+				return fmt.Errorf("unable to create form data: %w", err)
+			}
+		}
+	}
+	part, err := multipartWriter.CreateFormFile(filterFormKey, name)
+	if err != nil {
+		return fmt.Errorf("unable to create form data: %w", err)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to seek beginning of file: %w", err)
+	}
+	if _, err = io.Copy(part, limitUploadRate(ctx, file)); err != nil {
+		return fmt.Errorf("unable to write file in form field: %w", err)
+	}
+	if err = multipartWriter.Close(); err != nil {
+		return fmt.Errorf("unable to finish form data: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+func init() {
+	adminEndpoints["jobs"] = adminEndpoint{handler: handleJobsList}
+}
+
+type jobInfo struct {
+	Key     string    `json:"key"`
+	ID      int64     `json:"id"`
+	Started time.Time `json:"started"`
+	Phase   string    `json:"phase"`
+}
+
+// handleJobsList GET /iuo/jobs, the uploads being processed, oldest first. A job stuck here makes IUO answer
+// "already processing this file" to the uploads of the same file
+func handleJobsList(w http.ResponseWriter, r *http.Request) {
+	if !jobsAPI {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := []jobInfo{}
+	jobs.Range(func(key, value any) bool {
+		job := value.(*runningJob)
+		list = append(list, jobInfo{Key: key.(string), ID: job.id, Started: job.started, Phase: jobPhaseNames[job.phase.Load()]})
+		return true
+	})
+	slices.SortFunc(list, func(a, b jobInfo) int { return a.Started.Compare(b.Started) })
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func discardLogger() *customLogger {
+	return newCustomLogger(log.New(io.Discard, "", 0), "")
+}
+
+// useUpstream points the upstream of the proxy to server for the test
+func useUpstream(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	previousURL, previousRemote, previousProxy := upstreamURL, remote, proxy
+	upstreamURL = server.URL
+	// The uploads IUO doesn't process go through the proxy
+	remote, _ = url.Parse(server.URL)
+	proxy = httputil.NewSingleHostReverseProxy(remote)
+	t.Cleanup(func() { upstreamURL, remote, proxy = previousURL, previousRemote, previousProxy })
+}
+
+// receivedUpload what the upstream of recordingUpstream got: the file part and the other fields
+type receivedUpload struct {
+	formKey  string
+	filename string
+	content  []byte
+	values   url.Values
+}
+
+// recordingUpstream an immich storing every upload it gets in the returned slice, answering 201
+func recordingUpstream(t *testing.T) *[]receivedUpload {
+	t.Helper()
+	var mu sync.Mutex
+	var uploads []receivedUpload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("upstream got no multipart form: %v", err)
+			return
+		}
+		upload := receivedUpload{values: url.Values{}}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("upstream got a broken form: %v", err)
+				return
+			}
+			content, _ := io.ReadAll(part)
+			if part.FileName() == "" {
+				upload.values.Add(part.FormName(), string(content))
+				continue
+			}
+			upload.formKey, upload.filename, upload.content = part.FormName(), part.FileName(), content
+		}
+		mu.Lock()
+		uploads = append(uploads, upload)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `{"id":"a","status":"created"}`)
+	}))
+	t.Cleanup(server.Close)
+	useUpstream(t, server)
+	return &uploads
+}
+
+// uploadRequest a parsed upload from a client, method and target like the client sent them
+func uploadRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	r.MultipartForm = &multipart.Form{Value: url.Values{"deviceAssetId": {"a"}, "deviceId": {"d"}}}
+	return r
+}
+
+func jsonResponse(status int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(bytes.NewReader(body))}
+}
+
+func gzipped(t *testing.T, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIsDuplicateUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		body   []byte
+		want   bool
+	}{
+		{"created", http.StatusCreated, nil, []byte(`{"id":"a","status":"created"}`), false},
+		{"duplicate", http.StatusOK, nil, []byte(`{"id":"a","status":"duplicate"}`), true},
+		{"ok not duplicate", http.StatusOK, nil, []byte(`{"id":"a","status":"created"}`), false},
+		{"ok not json", http.StatusOK, nil, []byte(`not json`), false},
+		{"gzip duplicate", http.StatusOK, http.Header{"Content-Encoding": {"gzip"}}, gzipped(t, `{"id":"a","status":"duplicate"}`), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := jsonResponse(test.status, test.header, test.body)
+			if got := isDuplicateUpload(resp); got != test.want {
+				t.Errorf("isDuplicateUpload() = %v, want %v", got, test.want)
+			}
+			// Forwarded to the client as immich sent it
+			forwarded, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(forwarded, test.body) {
+				t.Errorf("body after check = %q, want %q", forwarded, test.body)
+			}
+		})
+	}
+}
+
+func TestUploadUpstreamReplace(t *testing.T) {
+	const replacePath = "/api/assets/11111111-2222-3333-4444-555555555555/original"
+	for _, test := range []struct {
+		status        string
+		wantDuplicate bool
+	}{
+		{"replaced", false},
+		{"duplicate", true},
+	} {
+		t.Run(test.status, func(t *testing.T) {
+			body := `{"id":"11111111-2222-3333-4444-555555555555","status":"` + test.status + `"}`
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut || r.URL.Path != replacePath {
+					t.Errorf("upstream got %s %s, want PUT %s", r.Method, r.URL.Path, replacePath)
+				}
+				_, _ = io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				// Immich answers 200 to a replace, whatever its status
+				_, _ = io.WriteString(w, body)
+			}))
+			defer server.Close()
+			useUpstream(t, server)
+
+			r := uploadRequest(http.MethodPut, replacePath)
+			if !isAssetsUpload(r) {
+				t.Fatal("replace isn't handled as an upload")
+			}
+			w := httptest.NewRecorder()
+			duplicate, err := uploadUpstream(w, r, strings.NewReader("processed"), "file.avif", nil, nil, discardLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if duplicate != test.wantDuplicate {
+				t.Errorf("duplicate = %v, want %v", duplicate, test.wantDuplicate)
+			}
+			if w.Code != http.StatusOK || w.Body.String() != body {
+				t.Errorf("client got %d %q, want 200 %q", w.Code, w.Body.String(), body)
+			}
+		})
+	}
+}
+
+// disconnectingUpstream reads the start of each upload, then drops the connection without answering
+func disconnectingUpstream(t *testing.T, attempts *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		_, _ = io.CopyN(io.Discard, r.Body, 1024)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		_ = conn.Close()
+	}))
+}
+
+func TestUploadUpstreamDisconnected(t *testing.T) {
+	for _, retries := range []uint{0, 2} {
+		t.Run(fmt.Sprintf("%d retries", retries), func(t *testing.T) {
+			previous := uploadRetries
+			uploadRetries = retries
+			defer func() { uploadRetries = previous }()
+			var attempts atomic.Int32
+			server := disconnectingUpstream(t, &attempts)
+			defer server.Close()
+			useUpstream(t, server)
+
+			// Much bigger than the pipe and socket buffers, the writer is still busy when upstream leaves
+			file := bytes.NewReader(make([]byte, 16<<20))
+			w := httptest.NewRecorder()
+			_, err := uploadUpstream(w, uploadRequest(http.MethodPost, "/api/assets"), file, "file.jpg", nil, nil, discardLogger())
+			if !errors.Is(err, errUpstreamDisconnected) {
+				t.Fatalf("err = %v, want %v", err, errUpstreamDisconnected)
+			}
+			if got := uint(attempts.Load()); got != retries+1 {
+				t.Errorf("%d attempts, want %d", got, retries+1)
+			}
+			if w.Body.Len() > 0 {
+				t.Errorf("client got a body: %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUploadJobKey(t *testing.T) {
+	sum := func(content string) string {
+		hash := sha1.Sum([]byte(content))
+		return base64.StdEncoding.EncodeToString(hash[:])
+	}
+	upload := func(filename, content, apiKey string) string {
+		r := uploadRequest(http.MethodPost, "/api/assets")
+		if apiKey != "" {
+			r.Header.Set("X-Api-Key", apiKey)
+		}
+		r.Header.Set("x-immich-checksum", sum(content))
+		clientChecksum, _ := uploadChecksum(r)
+		return uploadJobKey(r, &multipart.FileHeader{Filename: filename, Size: int64(len(content))}, clientChecksum)
+	}
+	tests := []struct {
+		name    string
+		first   string
+		second  string
+		sameJob bool
+	}{
+		{"same bytes, other name", upload("IMG_0001.jpg", "content", "key"), upload("copy.jpg", "content", "key"), true},
+		{"same name, other bytes", upload("IMG_0001.jpg", "content", "key"), upload("IMG_0001.jpg", "CONTENT", "key"), false},
+		{"same bytes, other user", upload("IMG_0001.jpg", "content", "key"), upload("IMG_0001.jpg", "content", "other"), false},
+		{"same bytes, no credentials", upload("IMG_0001.jpg", "content", ""), upload("copy.jpg", "content", ""), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if sameJob := test.first == test.second; sameJob != test.sameJob {
+				t.Errorf("keys %q and %q: same job %v, want %v", test.first, test.second, sameJob, test.sameJob)
+			}
+		})
+	}
+}
+
+// memoryChecksumStore records the mappings of a test
+type memoryChecksumStore map[string]string
+
+func (store memoryChecksumStore) Add(newHash, originalHash string) error {
+	store[newHash] = originalHash
+	return nil
+}
+
+func (store memoryChecksumStore) Lookup(newHash string) (string, bool) {
+	originalHash, ok := store[newHash]
+	return originalHash, ok
+}
+
+func (store memoryChecksumStore) Reverse(originalHash string) (newHashes []string) {
+	for newHash, original := range store {
+		if original == originalHash {
+			newHashes = append(newHashes, newHash)
+		}
+	}
+	return
+}
+
+func useChecksumStore(t *testing.T) memoryChecksumStore {
+	t.Helper()
+	store := memoryChecksumStore{}
+	previous := checksums
+	checksums = store
+	t.Cleanup(func() { checksums = previous })
+	return store
+}
+
+// clientUpload an upload of filename with content like an immich client sends it
+func clientUpload(t *testing.T, filename string, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range map[string]string{"deviceAssetId": "a", "deviceId": "d", "fileCreatedAt": "2024-01-01T00:00:00Z", "fileModifiedAt": "2024-01-01T00:00:00Z"} {
+		if err := writer.WriteField(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := writer.CreateFormFile(filterFormKey, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/assets", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	hash := sha1.Sum(content)
+	r.Header.Set("x-immich-checksum", base64.StdEncoding.EncodeToString(hash[:]))
+	return r
+}
+
+func TestNewJobEmptyProcessedFile(t *testing.T) {
+	store := useChecksumStore(t)
+	var uploaded []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile(filterFormKey)
+		if err != nil {
+			t.Errorf("upstream got no file: %v", err)
+			return
+		}
+		defer file.Close()
+		uploaded, _ = io.ReadAll(file)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `{"id":"a","status":"created"}`)
+	}))
+	defer server.Close()
+	useUpstream(t, server)
+	// Exits 0 like a killed encoder, without writing anything
+	useTask(t, &Task{Name: "empty", Extensions: []string{"jpg"}, Command: `: > "{{.result_folder}}/{{.name}}.avif"`})
+
+	original := []byte("original jpg")
+	w := httptest.NewRecorder()
+	if err := newJob(clientUpload(t, "photo.jpg", original), w, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated {
+		t.Errorf("client got %d, want 201", w.Code)
+	}
+	if !bytes.Equal(uploaded, original) {
+		t.Errorf("upstream got %q, want the original", uploaded)
+	}
+	if len(store) > 0 {
+		t.Errorf("checksum mappings stored: %v", store)
+	}
+}
+
+func TestNewJobUpstreamDown(t *testing.T) {
+	// A port nothing listens on anymore
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = listener.Close()
+	previous := upstreamURL
+	upstreamURL = "http://" + listener.Addr().String()
+	defer func() { upstreamURL = previous }()
+	useConfig(t)
+	initJobSlots()
+
+	w := httptest.NewRecorder()
+	done := make(chan error, 1)
+	go func() { done <- newJob(clientUpload(t, "photo.jpg", []byte("jpg")), w, discardLogger()) }()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("job still running with the upstream down")
+	}
+	if !errors.Is(err, errUpstreamDisconnected) {
+		t.Errorf("err = %v, want %v", err, errUpstreamDisconnected)
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("client got %d, want 502", w.Code)
+	}
+}
+
+func TestUploadUpstreamHeader(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `{"id":"a","status":"created"}`)
+	}))
+	defer server.Close()
+	useUpstream(t, server)
+	previousHeaders, previousTransport := upstreamHeaders, upstreamTransport
+	defer func() { upstreamHeaders, upstreamTransport = previousHeaders, previousTransport }()
+	upstreamHeaders = headerFlag{}
+	if err := upstreamHeaders.Set("X-Proxy-Auth: secret"); err != nil {
+		t.Fatal(err)
+	}
+	upstreamTransport = newUpstreamTransport()
+
+	r := uploadRequest(http.MethodPost, "/api/assets")
+	// Replaced, not added to
+	r.Header.Set("X-Proxy-Auth", "from the client")
+	if _, err := uploadUpstream(httptest.NewRecorder(), r, strings.NewReader("jpg"), "file.jpg", nil, nil, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if values := got.Values("X-Proxy-Auth"); len(values) != 1 || values[0] != "secret" {
+		t.Errorf("upstream got X-Proxy-Auth %q, want secret", values)
+	}
+}
+
+func TestNewJobOtherFormKey(t *testing.T) {
+	uploads := recordingUpstream(t)
+	useTask(t, &Task{Name: "avif", Extensions: []string{"jpg"}, Command: `printf avif > "{{.result_folder}}/{{.name}}.avif"`})
+	r := clientUpload(t, "photo.jpg", []byte("original jpg"))
+	previous := filterFormKey
+	filterFormKey = "file"
+	defer func() { filterFormKey = previous }()
+
+	w := httptest.NewRecorder()
+	if err := newJob(r, w, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated {
+		t.Errorf("client got %d, want 201", w.Code)
+	}
+	if len(*uploads) != 1 {
+		t.Fatalf("upstream got %d uploads, want 1", len(*uploads))
+	}
+	if got := (*uploads)[0]; got.formKey != previous || got.filename != "photo.jpg" || string(got.content) != "original jpg" || got.values.Get("deviceAssetId") != "a" {
+		t.Errorf("upstream got %s=%s %q %v, want the upload as sent", got.formKey, got.filename, got.content, got.values)
+	}
+}
+
+func TestNewJobVideoJobsDisabled(t *testing.T) {
+	uploads := recordingUpstream(t)
+	useTask(t, &Task{Name: "hevc", Extensions: []string{"mp4"}, Command: `printf hevc > "{{.result_folder}}/{{.name}}.mp4"`})
+	previous := disableVideoJobs
+	disableVideoJobs = true
+	defer func() { disableVideoJobs = previous }()
+
+	w := httptest.NewRecorder()
+	if err := newJob(clientUpload(t, "clip.mp4", []byte("original mp4")), w, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*uploads) != 1 {
+		t.Fatalf("upstream got %d uploads, want 1", len(*uploads))
+	}
+	if got := (*uploads)[0]; got.filename != "clip.mp4" || string(got.content) != "original mp4" {
+		t.Errorf("upstream got %s %q, want the video untouched", got.filename, got.content)
+	}
+}
+
+func TestNewJobUnexpectedOutputExtension(t *testing.T) {
+	tests := []struct {
+		name             string
+		output           string
+		outputExtensions []string
+	}{
+		{"not a media file", "log", nil},
+		{"not in output_extensions", "webp", []string{"avif"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uploads := recordingUpstream(t)
+			useTask(t, &Task{Name: "avif", Extensions: []string{"jpg"}, OutputExtensions: test.outputExtensions, Command: `printf out > "{{.result_folder}}/{{.name}}.` + test.output + `"`})
+			w := httptest.NewRecorder()
+			if err := newJob(clientUpload(t, "photo.jpg", []byte("original jpg")), w, discardLogger()); err != nil {
+				t.Fatal(err)
+			}
+			if len(*uploads) != 1 {
+				t.Fatalf("upstream got %d uploads, want 1", len(*uploads))
+			}
+			if got := (*uploads)[0]; got.filename != "photo.jpg" || string(got.content) != "original jpg" {
+				t.Errorf("upstream got %s %q, want the original", got.filename, got.content)
+			}
+		})
+	}
+}
+
+func TestNewJobUploadNames(t *testing.T) {
+	uploads := recordingUpstream(t)
+	useChecksumStore(t)
+	useTask(t, &Task{Name: "avif", Extensions: []string{"jpg"}, Command: `printf avif > "{{.result_folder}}/{{.name}}.avif"`})
+	r := clientUpload(t, "photo.jpg", []byte("original jpg"))
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	// Sent by the web client, Immich names the asset after it
+	r.MultipartForm.Value["filename"] = []string{"photo.jpg"}
+
+	w := httptest.NewRecorder()
+	if err := newJob(r, w, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*uploads) != 1 {
+		t.Fatalf("upstream got %d uploads, want 1", len(*uploads))
+	}
+	got := (*uploads)[0]
+	if got.formKey != filterFormKey || got.filename != "photo.avif" || string(got.content) != "avif" {
+		t.Errorf("upstream got the part %s=%s %q, want %s=photo.avif with the processed file", got.formKey, got.filename, got.content, filterFormKey)
+	}
+	if filename := got.values["filename"]; len(filename) != 1 || filename[0] != "photo.avif" {
+		t.Errorf("upstream got the filename field %q, want photo.avif", filename)
+	}
+	// The client tracks its uploads with it
+	if got.values.Get("deviceAssetId") != "a" {
+		t.Errorf("upstream got deviceAssetId %q, want it unchanged", got.values.Get("deviceAssetId"))
+	}
+}
+
+func TestNewJobPostCommand(t *testing.T) {
+	recordingUpstream(t)
+	store := useChecksumStore(t)
+	marker := filepath.Join(t.TempDir(), "marker")
+	useTask(t, &Task{Name: "avif", Extensions: []string{"jpg"}, Command: `printf avif > "{{.result_folder}}/{{.name}}.avif"`,
+		PostCommand: `printf '%s\n' {{.task}} {{.original_filename}} {{.processed_filename}} {{.original_size}} {{.processed_size}} {{.original_hash}} {{.processed_hash}} > ` + shellQuote(marker)})
+
+	if err := newJob(clientUpload(t, "my photo.jpg", []byte("original jpg")), httptest.NewRecorder(), discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	// Runs in the background, like the jobs shutdown waits for it
+	activeJobs.Wait()
+	data, err := os.ReadFile(marker)
+	if err != nil {
+		t.Fatalf("post_command didn't run: %v", err)
+	}
+	originalHash, processedHash := sha1.Sum([]byte("original jpg")), sha1.Sum([]byte("avif"))
+	want := []string{"avif", "my photo.jpg", "my photo.avif", "12", "4", base64.StdEncoding.EncodeToString(originalHash[:]), base64.StdEncoding.EncodeToString(processedHash[:])}
+	if got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); !slices.Equal(got, want) {
+		t.Errorf("post_command got %q, want %q", got, want)
+	}
+	if len(store) != 1 {
+		t.Errorf("checksum mappings %v, want the processed file mapped", store)
+	}
+}
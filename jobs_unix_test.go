@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestNewJobInflightBytesSerialized(t *testing.T) {
+	uploads := recordingUpstream(t)
+	useChecksumStore(t)
+	dir := t.TempDir()
+	running := filepath.Join(dir, "running")
+	if err := os.Mkdir(running, 0755); err != nil {
+		t.Fatal(err)
+	}
+	counts := filepath.Join(dir, "counts")
+	// Each command running holds a file in running and records how many it sees
+	useTask(t, &Task{Name: "avif", Extensions: []string{"jpg"},
+		Command: fmt.Sprintf(`touch %[1]s/$$; ls %[1]s | wc -l >> %[2]s; sleep 0.2; rm %[1]s/$$; printf avif > "{{.result_folder}}/{{.name}}.avif"`, running, counts)})
+	// Enough job slots, only max_inflight_bytes holds the uploads back
+	previousSemaphore, previousMax, previousInflight := imageSemaphore, maxInflightBytes, inflightBytes
+	imageSemaphore, maxInflightBytes, inflightBytes = make(chan struct{}, 4), 100, semaphore.NewWeighted(100)
+	defer func() {
+		imageSemaphore, maxInflightBytes, inflightBytes = previousSemaphore, previousMax, previousInflight
+	}()
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Go(func() {
+			// Each one bigger than the whole budget, different so they aren't the same job
+			content := append([]byte(strconv.Itoa(i)), make([]byte, 200)...)
+			if err := newJob(clientUpload(t, fmt.Sprintf("photo%d.jpg", i), content), httptest.NewRecorder(), discardLogger()); err != nil {
+				t.Errorf("upload %d: %v", i, err)
+			}
+		})
+	}
+	wg.Wait()
+	data, err := os.ReadFile(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []int
+	for _, line := range strings.Fields(string(data)) {
+		count, _ := strconv.Atoi(line)
+		seen = append(seen, count)
+	}
+	if len(seen) != 4 || slices.Max(seen) != 1 {
+		t.Errorf("commands running at the same time: %v, want 4 runs one by one", seen)
+	}
+	if len(*uploads) != 4 {
+		t.Errorf("upstream got %d uploads, want 4", len(*uploads))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixListenPrefix marks a listen entry as a unix socket path instead of a host:port
+const unixListenPrefix = "unix:"
+
+// listen opens every -listen entry, closing the ones already opened if one fails
+func listen(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		listener, err := listenOn(addr)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, fmt.Errorf("unable to listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func listenOn(addr string) (net.Listener, error) {
+	socketPath, isUnix := strings.CutPrefix(addr, unixListenPrefix)
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, err
+	}
+	// Closing it on shutdown also removes the socket file
+	return net.Listen("unix", socketPath)
+}
+
+// removeStaleSocket the socket file left by a previous IUO that didn't stop cleanly would make listen fail. Anything else at the path is kept
+func removeStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", socketPath)
+	}
+	// Another process still serving on it
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use", socketPath)
+	}
+	return os.Remove(socketPath)
+}
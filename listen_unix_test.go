@@ -0,0 +1,68 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadThroughUnixSocket(t *testing.T) {
+	var uploaded []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile(filterFormKey)
+		if err != nil {
+			t.Errorf("upstream got no file: %v", err)
+			return
+		}
+		defer file.Close()
+		uploaded, _ = io.ReadAll(file)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `{"id":"a","status":"created"}`)
+	}))
+	defer server.Close()
+	useUpstream(t, server)
+	useConfig(t)
+	initJobSlots()
+	previous := baseLogger
+	baseLogger = log.New(io.Discard, "", 0)
+	defer func() { baseLogger = previous }()
+
+	socketPath := filepath.Join(t.TempDir(), "iuo.sock")
+	listeners, err := listen([]string{unixListenPrefix + socketPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &http.Server{Handler: http.HandlerFunc(handleRequest)}
+	go func() { _ = proxy.Serve(listeners[0]) }()
+	defer proxy.Close()
+
+	// The client reaches IUO through the reverse proxy in front of it, over the socket
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+	}}}
+	upload := clientUpload(t, "photo.jpg", []byte("jpg"))
+	req, err := http.NewRequest(upload.Method, "http://iuo"+upload.URL.Path, upload.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = upload.Header
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("client got %d, want 201", resp.StatusCode)
+	}
+	if string(uploaded) != "jpg" {
+		t.Errorf("upstream got %q, want the upload", uploaded)
+	}
+}
@@ -1,11 +1,34 @@
 package main
 
-import "log"
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
 
 type customLogger struct {
 	logger    *log.Logger
 	prefix    string
 	errPrefix string
+	// fields structured equivalent of prefix, only written by the json log format
+	fields []logField
+}
+
+type logField struct {
+	key   string
+	value any
 }
 
 func newCustomLogger(baseLogger interface{}, additionalPrefix string) *customLogger {
@@ -19,18 +42,71 @@ func newCustomLogger(baseLogger interface{}, additionalPrefix string) *customLog
 		return &customLogger{
 			logger: logger.logger,
 			prefix: logger.prefix + additionalPrefix,
+			fields: slices.Clip(logger.fields),
 		}
 	default:
 		panic("unsupported logger type")
 	}
 }
 
+// WithField adds a field to the json log lines, the text format is unchanged
+func (cl *customLogger) WithField(key string, value any) *customLogger {
+	return &customLogger{
+		logger:    cl.logger,
+		prefix:    cl.prefix,
+		errPrefix: cl.errPrefix,
+		fields:    append(slices.Clip(cl.fields), logField{key, value}),
+	}
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// minLogLevel messages below it are skipped
+var minLogLevel = levelInfo
+
 func (cl *customLogger) Println(v ...interface{}) {
-	cl.logger.Println(cl.prefix, v)
+	if minLogLevel > levelInfo {
+		return
+	}
+	if logFormat == "json" {
+		// Sprint only spaces operands that aren't strings, unlike Println
+		cl.printJSON(levelInfo, strings.TrimSuffix(fmt.Sprintln(v...), "\n"), nil)
+		return
+	}
+	cl.print(fmt.Sprintln(v...))
+}
+
+func (cl *customLogger) Debugf(format string, v ...interface{}) {
+	cl.logf(levelDebug, format, v...)
+}
+
+func (cl *customLogger) Infof(format string, v ...interface{}) {
+	cl.logf(levelInfo, format, v...)
 }
 
-func (cl *customLogger) Printf(format string, v ...interface{}) {
-	cl.logger.Printf(cl.prefix+format, v...)
+func (cl *customLogger) Warnf(format string, v ...interface{}) {
+	cl.logf(levelWarn, format, v...)
+}
+
+func (cl *customLogger) logf(level logLevel, format string, v ...interface{}) {
+	// Checked before formatting, debug messages can be built from big command lines
+	if level < minLogLevel {
+		return
+	}
+	if logFormat == "json" {
+		cl.printJSON(level, fmt.Sprintf(format, v...), nil)
+		return
+	}
+	cl.print(fmt.Sprintf(format, v...))
 }
 
 func (cl *customLogger) SetErrPrefix(prefix string) {
@@ -46,8 +122,128 @@ func (cl *customLogger) Error(err error, errorType string) bool {
 		if errorType != "" {
 			errorType = errorType + ": "
 		}
-		cl.logger.Printf(cl.prefix+cl.errPrefix+": "+errorType+"%v", err)
+		if logFormat == "json" {
+			cl.printJSON(levelError, errorType+err.Error(), map[string]any{"err_prefix": cl.errPrefix})
+			return true
+		}
+		cl.print(cl.errPrefix + ": " + errorType + err.Error())
 		return true
 	}
 	return false
 }
+
+// print writes the whole message with a single Output call, a multi-line task error can't be split by the lines of other jobs.
+// The continuation lines also get the prefix, grepping a job finds its whole error
+func (cl *customLogger) print(msg string) {
+	msg = strings.TrimSuffix(msg, "\n")
+	if cl.prefix != "" {
+		msg = strings.ReplaceAll(msg, "\n", "\n"+cl.prefix)
+	}
+	cl.logger.Print(cl.prefix + msg)
+}
+
+func (cl *customLogger) printJSON(level logLevel, msg string, extra map[string]any) {
+	entry := map[string]any{"time": time.Now().Format(time.RFC3339Nano), "level": logLevelNames[level], "msg": msg}
+	for _, field := range cl.fields {
+		entry[field.key] = field.value
+	}
+	for key, value := range extra {
+		entry[key] = value
+	}
+	line, err := encodeLogLine(entry)
+	if err != nil {
+		line, _ = encodeLogLine(map[string]any{"time": entry["time"], "level": "error", "msg": fmt.Sprintf("unable to encode log line: %v", err)})
+	}
+	cl.logger.Print(string(line))
+}
+
+// encodeLogLine without HTML escaping, commands often contain > and &
+func encodeLogLine(entry map[string]any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(entry); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// initLogging must run before anything is logged
+func initLogging() {
+	switch logFormat {
+	case "text":
+	case "json":
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{os.Stderr})
+	default:
+		log.Fatalf("invalid log_format: %s", logFormat)
+	}
+	switch logIPMode {
+	case "full", "masked", "none":
+	case "hashed":
+		if logIPSalt == "" {
+			salt := make([]byte, 32)
+			_, _ = rand.Read(salt)
+			logIPSalt = string(salt)
+		}
+	default:
+		log.Fatalf("invalid log_ip_mode: %s", logIPMode)
+	}
+	level := slices.Index(logLevelNames, strings.ToLower(logLevelFlag))
+	if level < 0 {
+		log.Fatalf("invalid log_level: %s", logLevelFlag)
+	}
+	minLogLevel = logLevel(level)
+}
+
+// loggedIP the IP of remoteAddr (ip:port, [ipv6]:port) as log_ip_mode wants it logged, empty with none
+func loggedIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	switch logIPMode {
+	case "none":
+		return ""
+	case "masked":
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			return "masked"
+		}
+		bits := 48
+		if addr.Unmap().Is4() {
+			addr, bits = addr.Unmap(), 24
+		}
+		prefix, _ := addr.Prefix(bits)
+		return prefix.Addr().String()
+	case "hashed":
+		mac := hmac.New(sha256.New, []byte(logIPSalt))
+		mac.Write([]byte(host))
+		return hex.EncodeToString(mac.Sum(nil))[:12]
+	}
+	return host
+}
+
+// newBaseLogger the json lines carry their own timestamp
+func newBaseLogger() *log.Logger {
+	if logFormat == "json" {
+		return log.New(os.Stdout, "", 0)
+	}
+	return log.New(os.Stdout, "", log.Ldate|log.Ltime)
+}
+
+// jsonLogWriter turns the lines of the standard logger into json log lines, log calls Write once per line
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := encodeLogLine(map[string]any{"time": time.Now().Format(time.RFC3339Nano), "level": "info", "msg": string(bytes.TrimSuffix(p, []byte("\n")))})
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.out.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useLogFormat sets log_format for the test, the returned logger writes in buf
+func useLogFormat(t *testing.T, format string, buf *bytes.Buffer) *customLogger {
+	t.Helper()
+	previous := logFormat
+	logFormat = format
+	t.Cleanup(func() { logFormat = previous })
+	return newCustomLogger(log.New(buf, "", 0), "1.2.3.4: ")
+}
+
+func TestPrintlnSpacesOperands(t *testing.T) {
+	var buf bytes.Buffer
+	useLogFormat(t, "text", &buf).Println("uploaded", "photo.jpg", 42)
+	if got, want := buf.String(), "1.2.3.4: uploaded photo.jpg 42\n"; got != want {
+		t.Errorf("text: %q, want %q", got, want)
+	}
+	buf.Reset()
+	useLogFormat(t, "json", &buf).Println("uploaded", "photo.jpg", 42)
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entry["msg"], "uploaded photo.jpg 42"; got != want {
+		t.Errorf("json msg: %q, want %q", got, want)
+	}
+}
+
+func TestLoggedIP(t *testing.T) {
+	previous := logIPMode
+	defer func() { logIPMode = previous }()
+	tests := []struct {
+		mode       string
+		remoteAddr string
+		want       string
+	}{
+		{"full", "192.168.1.20:54321", "192.168.1.20"},
+		{"full", "[2001:db8::1]:54321", "2001:db8::1"},
+		{"full", "[::1]:2284", "::1"},
+		{"full", "immich-app:54321", "immich-app"},
+		// No port, e.g. a unix socket peer
+		{"full", "192.168.1.20", "192.168.1.20"},
+		{"full", "2001:db8::1", "2001:db8::1"},
+		{"full", "@", "@"},
+		{"masked", "192.168.1.20:54321", "192.168.1.0"},
+		{"masked", "[2001:db8:1234:5678::1]:54321", "2001:db8:1234::"},
+		{"masked", "[::ffff:192.168.1.20]:54321", "192.168.1.0"},
+		{"masked", "immich-app:54321", "masked"},
+		{"none", "192.168.1.20:54321", ""},
+		{"none", "[2001:db8::1]:54321", ""},
+	}
+	for _, test := range tests {
+		logIPMode = test.mode
+		if got := loggedIP(test.remoteAddr); got != test.want {
+			t.Errorf("loggedIP(%q) with %s = %q, want %q", test.remoteAddr, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestLoggedIPHashed(t *testing.T) {
+	previousMode, previousSalt := logIPMode, logIPSalt
+	defer func() { logIPMode, logIPSalt = previousMode, previousSalt }()
+	logIPMode, logIPSalt = "hashed", "salt"
+	for _, addrs := range [][2]string{{"192.168.1.20:54321", "192.168.1.20:1"}, {"[2001:db8::1]:54321", "[2001:db8::1]:1"}} {
+		hash := loggedIP(addrs[0])
+		if len(hash) != 12 || strings.Contains(hash, ".") || strings.Contains(hash, ":") {
+			t.Errorf("loggedIP(%q) = %q, want 12 hex characters", addrs[0], hash)
+		}
+		if other := loggedIP(addrs[1]); other != hash {
+			t.Errorf("%s hashed to %q, %s to %q: the port must not change the hash", addrs[0], hash, addrs[1], other)
+		}
+		logIPSalt = "other salt"
+		if salted := loggedIP(addrs[0]); salted == hash {
+			t.Errorf("%s hashed to %q with both salts", addrs[0], hash)
+		}
+		logIPSalt = "salt"
+	}
+	if loggedIP("192.168.1.20:1") == loggedIP("192.168.1.21:1") {
+		t.Error("two IPs hashed the same")
+	}
+}
+
+func TestConcurrentErrorBlocks(t *testing.T) {
+	var buf bytes.Buffer
+	baseLogger := useLogFormat(t, "text", &buf).logger
+	const jobs, lines = 20, 5
+	var wg sync.WaitGroup
+	for job := range jobs {
+		wg.Go(func() {
+			logger := newCustomLogger(baseLogger, fmt.Sprintf("job %d: ", job))
+			logger.SetErrPrefix("upload")
+			var output []string
+			for line := range lines {
+				output = append(output, fmt.Sprintf("output line %d", line))
+			}
+			for range 10 {
+				logger.Error(errors.New("command failed\n"+strings.Join(output, "\n")), "task")
+			}
+		})
+	}
+	wg.Wait()
+	logged := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(logged) != jobs*10*(lines+1) {
+		t.Fatalf("%d lines logged, want %d", len(logged), jobs*10*(lines+1))
+	}
+	// Each error block is its first line followed by all its output lines, with the job prefix
+	for i := 0; i < len(logged); i += lines + 1 {
+		prefix, _, _ := strings.Cut(logged[i], "upload: ")
+		if !strings.HasPrefix(prefix, "job ") || !strings.HasSuffix(logged[i], "task: command failed") {
+			t.Fatalf("line %d isn't the start of an error: %q", i, logged[i])
+		}
+		for line := range lines {
+			if got, want := logged[i+1+line], fmt.Sprintf("%soutput line %d", prefix, line); got != want {
+				t.Fatalf("line %d = %q, want %q: the error block was split", i+1+line, got, want)
+			}
+		}
+	}
+}
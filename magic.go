@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"mime"
+	"strings"
+)
+
+type fileSignature struct {
+	extension string
+	mimeType  string
+	offset    int
+	magic     []byte
+}
+
+// fileSignatures Order matters: the generic ISO BMFF "ftyp" entry must come after the specific brands
+var fileSignatures = []fileSignature{
+	{"jpg", "image/jpeg", 0, []byte{0xFF, 0xD8, 0xFF}},
+	{"png", "image/png", 0, []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}},
+	{"gif", "image/gif", 0, []byte("GIF8")},
+	{"jxl", "image/jxl", 0, []byte{0x00, 0x00, 0x00, 0x0C, 0x4A, 0x58, 0x4C, 0x20, 0x0D, 0x0A, 0x87, 0x0A}},
+	{"jxl", "image/jxl", 0, []byte{0xFF, 0x0A}},
+	{"webp", "image/webp", 8, []byte("WEBP")},
+	{"avi", "video/x-msvideo", 8, []byte("AVI ")},
+	{"tif", "image/tiff", 0, []byte("II*\x00")},
+	{"tif", "image/tiff", 0, []byte("MM\x00*")},
+	{"mkv", "video/x-matroska", 0, []byte{0x1A, 0x45, 0xDF, 0xA3}},
+	{"avif", "image/avif", 4, []byte("ftypavif")},
+	{"avif", "image/avif", 4, []byte("ftypavis")},
+	{"heic", "image/heic", 4, []byte("ftypheic")},
+	{"heic", "image/heic", 4, []byte("ftypheix")},
+	{"heif", "image/heif", 4, []byte("ftypmif1")},
+	{"heif", "image/heif", 4, []byte("ftypmsf1")},
+	{"mov", "video/quicktime", 4, []byte("ftypqt  ")},
+	{"3gp", "video/3gpp", 4, []byte("ftyp3g")},
+	{"mp4", "video/mp4", 4, []byte("ftyp")},
+	{"bmp", "image/bmp", 0, []byte("BM")},
+}
+
+// sniffFileType detects the file type from its first bytes
+func sniffFileType(file io.ReaderAt) (fileSignature, bool) {
+	header := make([]byte, 16)
+	n, _ := file.ReadAt(header, 0)
+	header = header[:n]
+	for _, signature := range fileSignatures {
+		if len(header) >= signature.offset+len(signature.magic) && bytes.Equal(header[signature.offset:signature.offset+len(signature.magic)], signature.magic) {
+			return signature, true
+		}
+	}
+	return fileSignature{}, false
+}
+
+// imageDimensions reads only the image header. Formats without a Go decoder (e.g. HEIC, AVIF) report ok=false
+func imageDimensions(file io.ReaderAt) (width, height uint, ok bool) {
+	imageConfig, _, err := image.DecodeConfig(io.NewSectionReader(file, 0, math.MaxInt64))
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint(imageConfig.Width), uint(imageConfig.Height), true
+}
+
+// mimeTypeByExtension also knows image formats missing from the system mime types (e.g. heic, jxl)
+func mimeTypeByExtension(extension string) string {
+	extension = strings.ToLower(strings.TrimPrefix(extension, "."))
+	for _, signature := range fileSignatures {
+		if signature.extension == extension {
+			return signature.mimeType
+		}
+	}
+	return mime.TypeByExtension("." + extension)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,9 +14,19 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
 // goreleaser auto updated vars
@@ -27,19 +38,95 @@ var remote *url.URL
 var proxyUrl *url.URL
 
 var maxImageJobs uint
+var maxQueuedJobs uint
 var maxVideoJobs uint
+var maxInflightBytes uint64
 var imageSemaphore chan struct{}
 var videoSemaphore chan struct{}
+var maxDownloadJobs uint
+var downloadSemaphore chan struct{}
 
 var showVersion bool
+var checkConfig bool
+var strictBinaries bool
+var requireTmpfs bool
+var optimizePath string
+var disableImageJobs bool
+var disableVideoJobs bool
+var activeJobsFile string
 var upstreamURL string
 var listenAddr string
+var listenAddrs []string
 var configFile string
 var checksumsFile string
+var checksumsBackend string
+var checksumsCompactOnStart bool
+var checksumsAPI bool
+var jobsAPI bool
 var downloadJpgFromJxl bool
 var downloadJpgFromAvif bool
+var downloadJpgFromHeic bool
+var downloadJpgFromPng bool
+var djxlPath string
+var avifdecPath string
+var avifdecQuality uint
+var djxlThreads uint
+var heifConvertPath string
+var magickPath string
+var exiftoolPath string
+var maxFilenameLength uint
+var sanitizeFilenames bool
+var taskHeader bool
+var resultHeaders bool
+var uploadRetries uint
+var uploadRateLimit uint
+var webhookURL string
+var webhookOnPassthrough bool
+var duplicateJob string
+var allowedPathsList string
+var allowedPaths []string
+var maxCommandOutput uint
+var commandOutputDir string
+var detectMissingExtension bool
+var detectMime bool
+var minWidth uint
+var minHeight uint
+var dumpUpstreamDir string
+var dumpUpstreamAll bool
+var optimizeAfterFlag string
+var optimizeAfter time.Time
+var skipLivePhotos bool
+var restoreUploadResponse bool
+var sha1Command string
+var sha1CommandMinSize uint64
+var logHashTiming bool
+var adminToken string
+var downloadOrientation string
+var runAsFlag string
+var runAsGlobal *commandUser
+var shutdownTimeout time.Duration
+var upstreamDialTimeout time.Duration
+var upstreamResponseHeaderTimeout time.Duration
+var upstreamTimeout time.Duration
+var keepOriginal bool
+var keepOriginalSuffix string
+var upstreamCAFile string
+var upstreamInsecureSkipVerify bool
+var maxWebSockets uint
+var webSocketIdleTimeout time.Duration
 
-var config *Config
+// filterFormKey form field holding the uploaded file
+var filterFormKey string
+var downloadCacheSizeMB uint
+var logFormat string
+var logLevelFlag string
+var logIPMode string
+var logIPSalt string
+var ffmpegPath string
+var ffprobePath string
+
+// config swapped on SIGHUP
+var config atomic.Pointer[Config]
 
 func init() {
 	viper.SetEnvPrefix("iuo")
@@ -47,42 +134,272 @@ func init() {
 	viper.BindEnv("upstream")
 	viper.BindEnv("listen")
 	viper.BindEnv("tasks_file")
+	viper.BindEnv("checksums_backend")
+	viper.BindEnv("checksums_compact_on_start")
+	viper.BindEnv("checksums_api")
+	viper.BindEnv("jobs_api")
 	viper.BindEnv("download_jpg_from_jxl")
 	viper.BindEnv("download_jpg_from_avif")
+	viper.BindEnv("djxl_path")
+	viper.BindEnv("avifdec_path")
+	viper.BindEnv("avifdec_quality")
+	viper.BindEnv("djxl_threads")
+	viper.BindEnv("heif_convert_path")
+	viper.BindEnv("magick_path")
+	viper.BindEnv("exiftool_path")
+	viper.BindEnv("download_jpg_from_heic")
+	viper.BindEnv("download_jpg_from_png")
 	viper.BindEnv("max_image_jobs")
+	viper.BindEnv("max_queued_jobs")
 	viper.BindEnv("max_video_jobs")
+	viper.BindEnv("max_inflight_bytes")
+	viper.BindEnv("disable_image_jobs")
+	viper.BindEnv("disable_video_jobs")
+	viper.BindEnv("active_jobs_file")
+	viper.BindEnv("max_download_jobs")
+	viper.BindEnv("max_filename_length")
+	viper.BindEnv("sanitize_filenames")
+	viper.BindEnv("task_header")
+	viper.BindEnv("result_headers")
+	viper.BindEnv("upload_retries")
+	viper.BindEnv("upload_rate_limit")
+	viper.BindEnv("strict_binaries")
+	viper.BindEnv("require_tmpfs")
+	viper.BindEnv("webhook_url")
+	viper.BindEnv("webhook_on_passthrough")
+	viper.BindEnv("duplicate_job")
+	viper.BindEnv("allowed_paths")
+	viper.BindEnv("max_command_output")
+	viper.BindEnv("command_output_dir")
+	viper.BindEnv("detect_missing_extension")
+	viper.BindEnv("detect_mime")
+	viper.BindEnv("min_width")
+	viper.BindEnv("min_height")
+	viper.BindEnv("dump_upstream_dir")
+	viper.BindEnv("dump_upstream_all")
+	viper.BindEnv("optimize_after")
+	viper.BindEnv("skip_live_photos")
+	viper.BindEnv("restore_upload_response")
+	viper.BindEnv("sha1_command")
+	viper.BindEnv("sha1_command_min_size")
+	viper.BindEnv("log_hash_timing")
+	viper.BindEnv("admin_token")
+	viper.BindEnv("download_orientation")
+	viper.BindEnv("run_as")
+	viper.BindEnv("shutdown_timeout")
+	viper.BindEnv("upstream_dial_timeout")
+	viper.BindEnv("upstream_response_header_timeout")
+	viper.BindEnv("upstream_timeout")
+	viper.BindEnv("keep_original")
+	viper.BindEnv("keep_original_suffix")
+	viper.BindEnv("upstream_header")
+	viper.BindEnv("upstream_ca_file")
+	viper.BindEnv("upstream_insecure_skip_verify")
+	viper.BindEnv("max_websockets")
+	viper.BindEnv("websocket_idle_timeout")
+	viper.BindEnv("form_key")
+	viper.BindEnv("download_cache_size_mb")
+	viper.BindEnv("log_format")
+	viper.BindEnv("log_level")
+	viper.BindEnv("log_ip_mode")
+	viper.BindEnv("log_ip_salt")
+	viper.BindEnv("ffmpeg_path")
+	viper.BindEnv("ffprobe_path")
 
 	viper.SetDefault("upstream", "")
 	viper.SetDefault("listen", ":2284")
 	viper.SetDefault("tasks_file", "config/lossy_avif.yaml")
 	viper.SetDefault("checksums_file", "checksums.csv")
+	viper.SetDefault("checksums_backend", "csv")
+	viper.SetDefault("checksums_compact_on_start", false)
+	viper.SetDefault("checksums_api", false)
+	viper.SetDefault("jobs_api", false)
 	viper.SetDefault("download_jpg_from_jxl", false)
 	viper.SetDefault("download_jpg_from_avif", false)
+	viper.SetDefault("djxl_path", "djxl")
+	viper.SetDefault("avifdec_path", "avifdec")
+	viper.SetDefault("avifdec_quality", 95)
+	viper.SetDefault("djxl_threads", 0)
+	viper.SetDefault("heif_convert_path", "heif-convert")
+	viper.SetDefault("magick_path", "magick")
+	viper.SetDefault("exiftool_path", "exiftool")
+	viper.SetDefault("download_jpg_from_heic", false)
+	viper.SetDefault("download_jpg_from_png", false)
 	viper.SetDefault("max_image_jobs", 5)
+	viper.SetDefault("max_queued_jobs", 0)
 	viper.SetDefault("max_video_jobs", 1)
+	viper.SetDefault("max_inflight_bytes", 0)
+	viper.SetDefault("disable_image_jobs", false)
+	viper.SetDefault("disable_video_jobs", false)
+	viper.SetDefault("active_jobs_file", "")
+	viper.SetDefault("max_download_jobs", 4)
+	viper.SetDefault("max_filename_length", 0)
+	viper.SetDefault("sanitize_filenames", false)
+	viper.SetDefault("task_header", false)
+	viper.SetDefault("result_headers", false)
+	viper.SetDefault("upload_retries", 0)
+	viper.SetDefault("upload_rate_limit", 0)
+	viper.SetDefault("strict_binaries", false)
+	viper.SetDefault("require_tmpfs", false)
+	viper.SetDefault("webhook_url", "")
+	viper.SetDefault("webhook_on_passthrough", false)
+	viper.SetDefault("duplicate_job", "reject")
+	viper.SetDefault("allowed_paths", "")
+	viper.SetDefault("max_command_output", 8192)
+	viper.SetDefault("command_output_dir", "")
+	viper.SetDefault("detect_missing_extension", true)
+	viper.SetDefault("detect_mime", false)
+	viper.SetDefault("min_width", 0)
+	viper.SetDefault("min_height", 0)
+	viper.SetDefault("dump_upstream_dir", "")
+	viper.SetDefault("dump_upstream_all", false)
+	viper.SetDefault("optimize_after", "")
+	viper.SetDefault("skip_live_photos", false)
+	viper.SetDefault("restore_upload_response", false)
+	viper.SetDefault("sha1_command", "")
+	viper.SetDefault("sha1_command_min_size", 104857600)
+	viper.SetDefault("log_hash_timing", false)
+	viper.SetDefault("admin_token", "")
+	viper.SetDefault("download_orientation", "none")
+	viper.SetDefault("run_as", "")
+	viper.SetDefault("shutdown_timeout", "30s")
+	viper.SetDefault("upstream_dial_timeout", "30s")
+	viper.SetDefault("upstream_response_header_timeout", "10m")
+	viper.SetDefault("upstream_timeout", 0)
+	viper.SetDefault("keep_original", false)
+	viper.SetDefault("keep_original_suffix", "-original")
+	viper.SetDefault("upstream_header", "")
+	viper.SetDefault("upstream_ca_file", "")
+	viper.SetDefault("upstream_insecure_skip_verify", false)
+	viper.SetDefault("max_websockets", 0)
+	viper.SetDefault("websocket_idle_timeout", "2m")
+	viper.SetDefault("form_key", "assetData")
+	viper.SetDefault("download_cache_size_mb", 0)
+	viper.SetDefault("log_format", "text")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log_ip_mode", "full")
+	viper.SetDefault("log_ip_salt", "")
+	viper.SetDefault("ffmpeg_path", "ffmpeg")
+	viper.SetDefault("ffprobe_path", "ffprobe")
 
 	flag.BoolVar(&showVersion, "version", false, "Show the current version")
+	flag.BoolVar(&checkConfig, "check_config", false, "Validate the tasks file and exit")
+	flag.BoolVar(&checkConfig, "check", false, "Alias of -check_config")
+	flag.StringVar(&optimizePath, "optimize", "", "Process this local file with the tasks file like an upload, print the result and exit")
 	flag.StringVar(&upstreamURL, "upstream", viper.GetString("upstream"), "Upstream URL. Example: http://immich-server:2283")
-	flag.StringVar(&listenAddr, "listen", viper.GetString("listen"), "Listening address")
-	flag.StringVar(&configFile, "tasks_file", viper.GetString("tasks_file"), "Path to the configuration file")
+	flag.StringVar(&listenAddr, "listen", viper.GetString("listen"), "Comma separated listening addresses: host:port or unix:/path/to.sock")
+	flag.StringVar(&configFile, "tasks_file", viper.GetString("tasks_file"), "Path to the configuration file, or a comma separated list of files merged in order")
 	flag.StringVar(&checksumsFile, "checksums_file", viper.GetString("checksums_file"), "Path to the checksums file")
+	flag.StringVar(&activeJobsFile, "active_jobs_file", viper.GetString("active_jobs_file"), "Path of the file listing the running jobs, the ones interrupted by a crash are logged and cleaned on start")
+	flag.BoolVar(&checksumsCompactOnStart, "checksums_compact_on_start", viper.GetBool("checksums_compact_on_start"), "Rewrites the csv checksums file on start keeping only the latest mapping of each checksum")
+	flag.BoolVar(&checksumsAPI, "checksums_api", viper.GetBool("checksums_api"), "Enables GET /iuo/checksums/{hash} to look up the checksum mapping, protected by -admin_token")
+	flag.BoolVar(&jobsAPI, "jobs_api", viper.GetBool("jobs_api"), "Enables GET /iuo/jobs to list the uploads being processed, protected by -admin_token")
+	flag.StringVar(&checksumsBackend, "checksums_backend", viper.GetString("checksums_backend"), "Storage of the checksums file: csv (loaded in memory) or sqlite")
 	flag.BoolVar(&downloadJpgFromJxl, "download_jpg_from_jxl", viper.GetBool("download_jpg_from_jxl"), "Converts JXL images to JPG on download for wider compatibility")
 	flag.BoolVar(&downloadJpgFromAvif, "download_jpg_from_avif", viper.GetBool("download_jpg_from_avif"), "Converts AVIF images to JPG on download for wider compatibility")
+	flag.StringVar(&djxlPath, "djxl_path", viper.GetString("djxl_path"), "Path or name in PATH of the djxl binary used by -download_jpg_from_jxl")
+	flag.StringVar(&avifdecPath, "avifdec_path", viper.GetString("avifdec_path"), "Path or name in PATH of the avifdec binary used by -download_jpg_from_avif")
+	flag.UintVar(&avifdecQuality, "avifdec_quality", viper.GetUint("avifdec_quality"), "JPG quality (0-100) of the AVIF converted on download by avifdec")
+	flag.UintVar(&djxlThreads, "djxl_threads", viper.GetUint("djxl_threads"), "Max threads used by djxl to convert a JXL on download. 0 leaves djxl's default")
+	flag.StringVar(&heifConvertPath, "heif_convert_path", viper.GetString("heif_convert_path"), "Path or name in PATH of the heif-convert binary used by -download_jpg_from_heic")
+	flag.StringVar(&magickPath, "magick_path", viper.GetString("magick_path"), "Path or name in PATH of the magick binary used by -download_jpg_from_png and -download_orientation bake")
+	flag.StringVar(&exiftoolPath, "exiftool_path", viper.GetString("exiftool_path"), "Path or name in PATH of the exiftool binary used by -download_orientation and the preserve_metadata tasks")
+	flag.BoolVar(&downloadJpgFromHeic, "download_jpg_from_heic", viper.GetBool("download_jpg_from_heic"), "Converts HEIC/HEIF images to JPG on download for wider compatibility")
+	flag.BoolVar(&downloadJpgFromPng, "download_jpg_from_png", viper.GetBool("download_jpg_from_png"), "Converts PNG images to JPG on download for wider compatibility")
 	flag.UintVar(&maxImageJobs, "max_image_jobs", viper.GetUint("max_image_jobs"), "Max number of image jobs running concurrently")
 	flag.UintVar(&maxVideoJobs, "max_video_jobs", viper.GetUint("max_video_jobs"), "Max number of video jobs running concurrently")
+	flag.BoolVar(&disableImageJobs, "disable_image_jobs", viper.GetBool("disable_image_jobs"), "Uploads images to immich as they are, whatever the tasks file")
+	flag.BoolVar(&disableVideoJobs, "disable_video_jobs", viper.GetBool("disable_video_jobs"), "Uploads videos to immich as they are, whatever the tasks file")
+	flag.UintVar(&maxQueuedJobs, "max_queued_jobs", viper.GetUint("max_queued_jobs"), "Max number of image/video jobs waiting for a free slot, more uploads get 503 with Retry-After. 0 means no limit")
+	flag.Uint64Var(&maxInflightBytes, "max_inflight_bytes", viper.GetUint64("max_inflight_bytes"), "Max total size of the uploads being processed, more jobs wait for running ones to end. A bigger upload runs alone. 0 means no limit")
+	flag.UintVar(&maxDownloadJobs, "max_download_jobs", viper.GetUint("max_download_jobs"), "Max number of download conversions running concurrently")
+	flag.UintVar(&maxFilenameLength, "max_filename_length", viper.GetUint("max_filename_length"), "Max length in bytes of uploaded filenames, 0 means no limit")
+	flag.BoolVar(&sanitizeFilenames, "sanitize_filenames", viper.GetBool("sanitize_filenames"), "Sanitizes invalid uploaded filenames instead of rejecting the upload")
+	flag.BoolVar(&taskHeader, "task_header", viper.GetBool("task_header"), "Adds an X-IUO-Task header with the matched task name to upload responses")
+	flag.BoolVar(&resultHeaders, "result_headers", viper.GetBool("result_headers"), "Adds X-IUO-Task, X-IUO-Action (optimized/passthrough), X-IUO-Original-Size and X-IUO-Processed-Size headers to upload responses")
+	flag.UintVar(&uploadRetries, "upload_retries", viper.GetUint("upload_retries"), "Number of times an upload is retried when the upstream closes the connection before answering")
+	flag.UintVar(&uploadRateLimit, "upload_rate_limit", viper.GetUint("upload_rate_limit"), "Max bytes per second of the files uploaded to Immich, shared by all the uploads. 0 means no limit")
+	flag.StringVar(&webhookURL, "webhook_url", viper.GetString("webhook_url"), "URL receiving a JSON POST with the stats of each optimized upload. Empty disables it")
+	flag.BoolVar(&webhookOnPassthrough, "webhook_on_passthrough", viper.GetBool("webhook_on_passthrough"), "Also calls webhook_url when the original is uploaded")
+	flag.StringVar(&duplicateJob, "duplicate_job", viper.GetString("duplicate_job"), "When a file is uploaded again while its job is running: reject (500), wait (answers with the response of the running job) or accept (202)")
+	flag.BoolVar(&strictBinaries, "strict_binaries", viper.GetBool("strict_binaries"), "Refuses to start, or to reload the tasks file, if a task binary can't be found instead of only logging it")
+	flag.BoolVar(&requireTmpfs, "require_tmpfs", viper.GetBool("require_tmpfs"), "Refuses to start unless TMPDIR is a tmpfs, to never write uploads to disk")
+	flag.StringVar(&allowedPathsList, "allowed_paths", viper.GetString("allowed_paths"), "Comma separated list of path prefixes allowed through the proxy, everything else gets 403. Empty allows all paths")
+	flag.UintVar(&maxCommandOutput, "max_command_output", viper.GetUint("max_command_output"), "Max bytes of a failed command output included in logs, keeping its beginning and end. 0 means no limit")
+	flag.StringVar(&commandOutputDir, "command_output_dir", viper.GetString("command_output_dir"), "Directory where the full output of failed commands is saved")
+	flag.BoolVar(&detectMissingExtension, "detect_missing_extension", viper.GetBool("detect_missing_extension"), "Detects the file type from its content when the uploaded filename has no extension")
+	flag.BoolVar(&detectMime, "detect_mime", viper.GetBool("detect_mime"), "Detects the file type from its content for every upload, a task matching it with mime_types wins over the extension")
+	flag.UintVar(&minWidth, "min_width", viper.GetUint("min_width"), "Images narrower than this are not processed, tasks can override it")
+	flag.UintVar(&minHeight, "min_height", viper.GetUint("min_height"), "Images shorter than this are not processed, tasks can override it")
+	flag.StringVar(&dumpUpstreamDir, "dump_upstream_dir", viper.GetString("dump_upstream_dir"), "Directory where uploads sent to the upstream are dumped (headers + body) when the client request has the X-IUO-Dump header")
+	flag.BoolVar(&dumpUpstreamAll, "dump_upstream_all", viper.GetBool("dump_upstream_all"), "Dumps every upload sent to the upstream, not only the ones with the X-IUO-Dump header")
+	flag.StringVar(&optimizeAfterFlag, "optimize_after", viper.GetString("optimize_after"), "Only assets created after this date are processed, older ones are passed through. Format: 2006-01-02 or RFC3339")
+	flag.BoolVar(&skipLivePhotos, "skip_live_photos", viper.GetBool("skip_live_photos"), "Uploads both halves of live photos unchanged: the still image linked to a video and the hidden motion video")
+	flag.BoolVar(&restoreUploadResponse, "restore_upload_response", viper.GetBool("restore_upload_response"), "Rewrites filename, mime type and checksum in the upload response back to the ones of the file uploaded by the client")
+	flag.StringVar(&sha1Command, "sha1_command", viper.GetString("sha1_command"), "External command computing the SHA1 of big files (e.g. sha1sum), the file path is appended to it. Empty uses the built-in implementation")
+	flag.Uint64Var(&sha1CommandMinSize, "sha1_command_min_size", viper.GetUint64("sha1_command_min_size"), "Min file size in bytes hashed with -sha1_command")
+	flag.BoolVar(&logHashTiming, "log_hash_timing", viper.GetBool("log_hash_timing"), "Logs how long each SHA1 computation takes")
+	flag.StringVar(&adminToken, "admin_token", viper.GetString("admin_token"), "Token required by the /iuo/ management endpoints, sent as \"Authorization: Bearer <token>\" or X-IUO-Token header. Empty leaves them unprotected")
+	flag.StringVar(&downloadOrientation, "download_orientation", viper.GetString("download_orientation"), "Orientation handling of JPGs converted on download: none, copy (copies the orientation tag, needs exiftool) or bake (rotates the pixels, needs exiftool and magick)")
+	flag.StringVar(&runAsFlag, "run_as", viper.GetString("run_as"), "Runs task commands as this user, format: uid[:gid]. IUO must run as root. Tasks can override it. Empty keeps IUO's user")
+	flag.DurationVar(&shutdownTimeout, "shutdown_timeout", viper.GetDuration("shutdown_timeout"), "On SIGINT/SIGTERM, how long to wait for running jobs to finish uploading before exiting")
+	flag.DurationVar(&upstreamDialTimeout, "upstream_dial_timeout", viper.GetDuration("upstream_dial_timeout"), "Max time to connect to Immich. 0 means no limit")
+	flag.DurationVar(&upstreamResponseHeaderTimeout, "upstream_response_header_timeout", viper.GetDuration("upstream_response_header_timeout"), "Max time Immich can take to answer once the request is sent, the upload itself isn't limited. 0 means no limit")
+	flag.DurationVar(&upstreamTimeout, "upstream_timeout", viper.GetDuration("upstream_timeout"), "Max duration of the requests made by IUO to Immich, body transfer included. 0 means no limit")
+	flag.BoolVar(&keepOriginal, "keep_original", viper.GetBool("keep_original"), "After uploading an optimized file, also uploads the original as a separate asset")
+	flag.StringVar(&keepOriginalSuffix, "keep_original_suffix", viper.GetString("keep_original_suffix"), "Added to the filename of the original uploaded by keep_original, before the extension")
+	if err := upstreamHeaders.setEnv(viper.GetString("upstream_header")); err != nil {
+		log.Fatalf("invalid IUO_UPSTREAM_HEADER: %v", err)
+	}
+	flag.Var(&upstreamHeaders, "upstream_header", "Header added to every request sent to Immich, format \"Name: Value\". Can be repeated")
+	flag.StringVar(&upstreamCAFile, "upstream_ca_file", viper.GetString("upstream_ca_file"), "PEM file with the CA certificates trusted for an https upstream, in addition to the system ones")
+	flag.BoolVar(&upstreamInsecureSkipVerify, "upstream_insecure_skip_verify", viper.GetBool("upstream_insecure_skip_verify"), "Doesn't verify the certificate of an https upstream. Insecure, prefer upstream_ca_file")
+	flag.UintVar(&maxWebSockets, "max_websockets", viper.GetUint("max_websockets"), "Max number of websocket connections proxied at the same time, further upgrades are rejected with 503. 0 means no limit")
+	flag.DurationVar(&webSocketIdleTimeout, "websocket_idle_timeout", viper.GetDuration("websocket_idle_timeout"), "A proxied websocket connection is closed when the client or Immich sends nothing for this long. 0 means no limit")
+	flag.StringVar(&filterFormKey, "form_key", viper.GetString("form_key"), "Multipart form field of the uploads holding the file. Uploads without it are forwarded unmodified")
+	flag.UintVar(&downloadCacheSizeMB, "download_cache_size_mb", viper.GetUint("download_cache_size_mb"), "Max size in MB of the cache of JPGs converted on download, stored in TMPDIR. 0 disables it")
+	flag.StringVar(&logFormat, "log_format", viper.GetString("log_format"), "Log format: text or json (one object per line)")
+	flag.StringVar(&logLevelFlag, "log_level", viper.GetString("log_level"), "Minimum level of the logged messages: debug, info, warn or error")
+	flag.StringVar(&logIPMode, "log_ip_mode", viper.GetString("log_ip_mode"), "How client IPs are logged: full, masked (last IPv4 byte, last 80 IPv6 bits zeroed), hashed (see log_ip_salt) or none")
+	flag.StringVar(&logIPSalt, "log_ip_salt", viper.GetString("log_ip_salt"), "Key of the HMAC of the IPs logged with log_ip_mode hashed, the same IP gets the same hash across restarts. Empty uses a random one, stable until restart")
+	flag.StringVar(&ffmpegPath, "ffmpeg_path", viper.GetString("ffmpeg_path"), "Path or name in PATH of the ffmpeg binary used by the segmented tasks")
+	flag.StringVar(&ffprobePath, "ffprobe_path", viper.GetString("ffprobe_path"), "Path or name in PATH of the ffprobe binary used by the segmented tasks")
+}
+
+// setup parses the flags and prepares what they configure. Not in init, so tests don't parse the flags of go test
+func setup() {
 	flag.Parse()
+	initLogging()
 
 	if showVersion {
 		fmt.Println(printVersion())
 		os.Exit(0)
 	}
 
+	if checkConfig {
+		os.Exit(runConfigCheck())
+	}
+
+	if optimizePath != "" {
+		os.Exit(runOptimize(optimizePath))
+	}
+
 	validateInput()
 
 	proxyUrl, _ = url.Parse("http://localhost:8080")
+	upstreamTransport = newUpstreamTransport()
 	imageSemaphore = make(chan struct{}, maxImageJobs)
 	videoSemaphore = make(chan struct{}, maxVideoJobs)
+	downloadSemaphore = make(chan struct{}, maxDownloadJobs)
+	if maxInflightBytes > 0 {
+		inflightBytes = semaphore.NewWeighted(int64(maxInflightBytes))
+	}
+	if uploadRateLimit > 0 {
+		// A burst of one second, a slow limit would otherwise split the file in tiny reads
+		uploadLimiter = rate.NewLimiter(rate.Limit(uploadRateLimit), int(uploadRateLimit))
+	}
 	initChecksums()
+	reconcileActiveJobs()
 }
 
 var baseLogger *log.Logger
@@ -92,8 +409,9 @@ var proxy *httputil.ReverseProxy
 var DevMITMproxy = version == "dev"
 
 func main() {
-	baseLogger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
-	log.Printf("Starting %s on %s...", printVersion(), listenAddr)
+	setup()
+	baseLogger = newBaseLogger()
+	log.Printf("Starting %s on %s...", printVersion(), strings.Join(listenAddrs, ", "))
 	tmpDir := os.Getenv("TMPDIR")
 	if tmpDir != "" {
 		info, err := os.Stat(tmpDir)
@@ -106,21 +424,88 @@ func main() {
 	} else {
 		log.Printf("no tmp directory set, uploaded files will be saved on disk multiple times, this can shorten your disk lifespan !")
 	}
+	if err := checkTempDir(os.TempDir()); err != nil {
+		log.Fatal(err)
+	}
+	// Created after cleaning TMPDIR
+	if downloadCacheSizeMB > 0 && isDownloadConversionEnabled() {
+		var err error
+		if convertedCache, err = newDownloadCache(int64(downloadCacheSizeMB) << 20); err != nil {
+			log.Fatal(err)
+		}
+	}
 	// Proxy
 	proxy = httputil.NewSingleHostReverseProxy(remote)
-	if DevMITMproxy {
-		proxy.Transport = http.DefaultTransport
-		proxy.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
-	}
-	server := &http.Server{Addr: listenAddr, Handler: http.HandlerFunc(handleRequest)}
-	if err := server.ListenAndServe(); err != nil {
+	proxy.Transport = upstreamTransport
+	listeners, err := listen(listenAddrs)
+	if err != nil {
 		log.Fatalf("Error starting immich-upload-optimizer: %v", err)
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var servers []*http.Server
+	for _, listener := range listeners {
+		server := &http.Server{Handler: http.HandlerFunc(handleRequest)}
+		servers = append(servers, server)
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Error starting immich-upload-optimizer: %v", err)
+			}
+		}()
+	}
+	go reloadConfigOnSIGHUP()
+	<-ctx.Done()
+	stop() // A second signal kills IUO right away
+	shutdown(servers)
+}
+
+func reloadConfigOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloadConfig()
+	}
+}
+
+// shutdown TMPDIR is only cleaned at startup, files of jobs still running when the timeout expires are left there
+func shutdown(servers []*http.Server) {
+	log.Printf("shutting down, waiting up to %s for running jobs...", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Jobs whose client disconnected aren't tracked by the server
+	jobsDone := make(chan error, 1)
+	go func() { jobsDone <- waitJobs(ctx) }()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Go(func() {
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("server shutdown: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+	if err := <-jobsDone; err != nil {
+		log.Printf("jobs still running, exiting anyway: %v", err)
+		return
+	}
+	log.Printf("shutdown complete")
 }
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	var err error
-	logger := newCustomLogger(baseLogger, fmt.Sprintf("%s: ", strings.Split(r.RemoteAddr, ":")[0]))
+	logger := newCustomLogger(baseLogger, "")
+	if clientIP := loggedIP(r.RemoteAddr); clientIP != "" {
+		logger = newCustomLogger(baseLogger, fmt.Sprintf("%s: ", clientIP)).WithField("client", clientIP)
+	}
+	if isAdminPath(r) {
+		handleAdminRequest(w, r, logger)
+		return
+	}
+	if !isAllowedPath(r.URL.Path) {
+		logger.Warnf("path not allowed: %s", r.URL.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
 		upgradeWebSocketRequest(w, r, logger)
 		return
@@ -128,11 +513,11 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		// Only print URL if the request was handled by IUO
 		if logger.HasErrPrefix() {
-			logger.Printf("request URL: %s", r.URL.String())
+			logger.Debugf("request URL: %s", r.URL.String())
 		}
 	}()
-	if downloadJpgFromJxl || downloadJpgFromAvif {
-		if ok, assetUUID := isOriginalDownloadPath(r); ok {
+	if ok, assetUUID := isOriginalDownloadPath(r); ok {
+		if raw := takeRawDownloadParam(r); !raw && isDownloadConversionEnabled() {
 			if err = downloadAndConvertImage(w, r, logger, assetUUID[1]); err == nil {
 				return
 			}
@@ -158,11 +543,71 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	proxy.ServeHTTP(w, r)
 }
 
-const (
-	NONE = iota
-	JXL
-	AVIF
-)
+// downloadConversion converts an original to JPG on download for wider compatibility
+type downloadConversion struct {
+	enabled   *bool
+	mimeTypes []string
+	// extensions of the original filename and of the file signatures accepted
+	extensions []string
+	binary     string
+	args       func(input, output string) []string
+}
+
+// downloadBinaryPaths binaries whose location can be configured
+var downloadBinaryPaths = map[string]*string{
+	"djxl":         &djxlPath,
+	"avifdec":      &avifdecPath,
+	"heif-convert": &heifConvertPath,
+	"magick":       &magickPath,
+	"exiftool":     &exiftoolPath,
+}
+
+// resolvedDownloadBinaries absolute path of the binaries of the enabled conversions, by binary name. Set at startup
+var resolvedDownloadBinaries = map[string]string{}
+
+var downloadConversions = []downloadConversion{
+	{&downloadJpgFromJxl, []string{"image/jxl"}, []string{"jxl"}, "djxl", djxlArgs},
+	{&downloadJpgFromAvif, []string{"image/avif"}, []string{"avif"}, "avifdec", avifdecArgs},
+	{&downloadJpgFromHeic, []string{"image/heic", "image/heif"}, []string{"heic", "heif"}, "heif-convert", func(input, output string) []string { return []string{"-q", "95", input, output} }},
+	// Also flattens transparency and 16-bit depth
+	{&downloadJpgFromPng, []string{"image/png"}, []string{"png"}, "magick", func(input, output string) []string {
+		return []string{input, "-background", "white", "-alpha", "remove", "-depth", "8", "-quality", "95", output}
+	}},
+}
+
+func djxlArgs(input, output string) []string {
+	if djxlThreads > 0 {
+		return []string{"--num_threads", strconv.FormatUint(uint64(djxlThreads), 10), input, output}
+	}
+	return []string{input, output}
+}
+
+func avifdecArgs(input, output string) []string {
+	return []string{"-q", strconv.FormatUint(uint64(avifdecQuality), 10), input, output}
+}
+
+func isDownloadConversionEnabled() bool {
+	return slices.ContainsFunc(downloadConversions, func(c downloadConversion) bool { return *c.enabled })
+}
+
+// findDownloadConversion nil if the mime type isn't converted
+func findDownloadConversion(mimeType string) *downloadConversion {
+	for i, c := range downloadConversions {
+		if *c.enabled && slices.Contains(c.mimeTypes, mimeType) {
+			return &downloadConversions[i]
+		}
+	}
+	return nil
+}
+
+// isConvertedOnDownload the original filename extension is one converted to JPG
+func isConvertedOnDownload(filename string) bool {
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+	return slices.ContainsFunc(downloadConversions, func(c downloadConversion) bool { return *c.enabled && slices.Contains(c.extensions, extension) })
+}
+
+// convertedCacheControl the one Immich sends with the originals: only the browser of the user caches the JPG, proxies must not re-encode it
+const convertedCacheControl = "private, max-age=86400, no-transform"
 
 func downloadAndConvertImage(w http.ResponseWriter, r *http.Request, logger *customLogger, assetUUID string) (err error) {
 	logger.SetErrPrefix("download and convert")
@@ -171,7 +616,7 @@ func downloadAndConvertImage(w http.ResponseWriter, r *http.Request, logger *cus
 	if req, err = http.NewRequest(r.Method, upstreamURL+"/api/assets/"+assetUUID, nil); logger.Error(err, "new GET") {
 		return
 	}
-	req.Header = r.Header
+	req.Header = wholeResourceHeader(r.Header)
 	if resp, err = getHTTPclient().Do(req); logger.Error(err, "getHTTPclient.Do") {
 		return
 	}
@@ -189,73 +634,145 @@ func downloadAndConvertImage(w http.ResponseWriter, r *http.Request, logger *cus
 	if err = json.Unmarshal(jsonBuf, &asset); logger.Error(err, "json unmarshal") {
 		return
 	}
-	mimeType := NONE
+	var conversion *downloadConversion
 	if n, ok := asset["originalMimeType"]; ok {
 		if originalMimeType, ok := n.(string); ok {
-			if downloadJpgFromJxl && originalMimeType == "image/jxl" {
-				mimeType = JXL
-			} else if downloadJpgFromAvif && originalMimeType == "image/avif" {
-				mimeType = AVIF
-			}
+			conversion = findDownloadConversion(originalMimeType)
 		}
 	}
-	if mimeType == NONE {
+	if conversion == nil {
 		return errors.New("no conversion needed")
 	}
-	// Download file and convert
-	logger.Printf("converting to jpg: %s", r.URL)
+	// The asset request above already checked the client can access it
+	key := downloadCacheKey(assetUUID, asset, conversion)
+	// Same in both modes and for every client, a JPG cached by the browser is revalidated without converting again
+	etag := `"` + downloadCacheHash(key) + `"`
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", convertedCacheControl)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	// Not compressed, unlike the proxied responses. Sets Content-Length and handles range requests
+	serve := func(modTime time.Time, jpg io.ReadSeeker) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", convertedCacheControl)
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeContent(w, r, "", modTime, jpg)
+	}
+	convert := func() (string, error) {
+		return convertOriginal(r, conversion, logger)
+	}
+	if convertedCache == nil {
+		var jpg []byte
+		if jpg, err = convertShared(key, convert); logger.Error(err, "shared conversion") {
+			return
+		}
+		// The JPG changes only with the asset
+		modTime, _ := time.Parse(time.RFC3339, fmt.Sprint(asset["updatedAt"]))
+		serve(modTime, bytes.NewReader(jpg))
+		return nil
+	}
+	var jpg *os.File
+	if jpg, err = convertedCache.open(key, convert); logger.Error(err, "download cache") {
+		return
+	}
+	defer jpg.Close()
+	var stat os.FileInfo
+	if stat, err = jpg.Stat(); logger.Error(err, "stat jpg") {
+		return
+	}
+	serve(stat.ModTime(), jpg)
+	return nil
+}
+
+// wholeResourceHeader the client headers without the range and conditional ones: they apply to the converted JPG,
+// Immich must send the whole original
+func wholeResourceHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, key := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		header.Del(key)
+	}
+	return header
+}
+
+// etagMatches the If-None-Match header lists etag, weak comparison like http.ServeContent
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// convertOriginal downloads the original and converts it, returning the path of the JPG which must be removed by the caller
+func convertOriginal(r *http.Request, conversion *downloadConversion, logger *customLogger) (jpgPath string, err error) {
+	logger.Debugf("converting to jpg: %s", r.URL)
+	var req *http.Request
+	var resp *http.Response
 	var blob *os.File
-	if req, err = http.NewRequest("GET", upstreamURL+r.URL.String(), nil); logger.Error(err, "new GET") {
+	// The client leaving stops the download, the wait for a slot and the conversion
+	ctx := r.Context()
+	if req, err = http.NewRequestWithContext(ctx, "GET", upstreamURL+r.URL.String(), nil); logger.Error(err, "new GET") {
 		return
 	}
-	req.Header = r.Header
+	req.Header = wholeResourceHeader(r.Header)
 	if resp, err = getHTTPclient().Do(req); logger.Error(err, "getHTTPclient.Do") {
 		return
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New(resp.Status)
+		logger.Error(err, "original download")
+		return
+	}
 	if blob, err = os.CreateTemp("", "blob-*"); logger.Error(err, "blob create") {
 		return
 	}
-	cleanupBlob := func() { blob.Close(); _ = os.Remove(blob.Name()) }
-	defer cleanupBlob()
+	defer func() { blob.Close(); _ = os.Remove(blob.Name()) }()
 	if _, err = io.Copy(blob, resp.Body); logger.Error(err, "blob copy") {
 		return
 	}
-	resp.Body.Close()
-	if _, err = blob.Seek(0, io.SeekStart); logger.Error(err, "blob seek") {
-		return
+	// A mislabeled asset must not reach the decoder
+	signature, ok := sniffFileType(blob)
+	if !ok || !slices.Contains(conversion.extensions, signature.extension) {
+		return "", fmt.Errorf("bad %s signature", conversion.extensions[0])
 	}
-	signature := make([]byte, 12)
-	if _, err = blob.Read(signature); logger.Error(err, "blob read") {
-		return
+	jpgPath = blob.Name() + ".jpg"
+	select {
+	case downloadSemaphore <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
+	defer func() { <-downloadSemaphore }()
 	var output []byte
-	var open *os.File
-	switch mimeType {
-	case JXL:
-		if !bytes.Equal(signature, []byte{0x00, 0x00, 0x00, 0x0C, 0x4A, 0x58, 0x4C, 0x20, 0x0D, 0x0A, 0x87, 0x0A}) {
-			return errors.New("bad jxl signature")
-		}
-		if output, err = exec.Command("djxl", blob.Name(), blob.Name()+".jpg").CombinedOutput(); logger.Error(err, "djxl") {
-			return
-		}
-	case AVIF:
-		if !bytes.Equal(signature[4:], []byte("ftypavif")) {
-			return errors.New("bad avif signature")
-		}
-		if output, err = exec.Command("avifdec", "-q", "95", blob.Name(), blob.Name()+".jpg").CombinedOutput(); logger.Error(err, "avifdec") {
-			return
-		}
-	default:
-		return errors.New("should never happen")
+	if output, err = exec.CommandContext(ctx, resolvedDownloadBinaries[conversion.binary], conversion.args(blob.Name(), jpgPath)...).CombinedOutput(); logger.Error(err, conversion.binary) {
+		_ = os.Remove(jpgPath)
+		return "", err
 	}
-	logger.Printf("conversion complete: %s", strings.ReplaceAll(string(output), "\n", " - "))
-	cleanupBlob()
-	if open, err = os.Open(blob.Name() + ".jpg"); logger.Error(err, "open jpg") {
-		return
+	logger.Debugf("conversion complete: %s", strings.ReplaceAll(string(output), "\n", " - "))
+	if err = fixConvertedOrientation(ctx, blob.Name(), jpgPath); logger.Error(err, "orientation") {
+		_ = os.Remove(jpgPath)
+		return "", err
 	}
-	defer func() { open.Close(); _ = os.Remove(open.Name()) }()
-	if _, err = io.Copy(w, open); logger.Error(err, "write resp") {
-		return
+	return jpgPath, nil
+}
+
+// fixConvertedOrientation applies download_orientation: the converted jpg may have lost the orientation of the original
+func fixConvertedOrientation(ctx context.Context, original, converted string) error {
+	if downloadOrientation == "none" {
+		return nil
+	}
+	if output, err := exec.CommandContext(ctx, resolvedDownloadBinaries["exiftool"], "-q", "-overwrite_original", "-TagsFromFile", original, "-Orientation", converted).CombinedOutput(); err != nil {
+		return fmt.Errorf("exiftool: %w: %s", err, output)
+	}
+	if downloadOrientation == "bake" {
+		// For clients that ignore the orientation tag, auto-orient also resets it
+		if output, err := exec.CommandContext(ctx, resolvedDownloadBinaries["magick"], converted, "-auto-orient", "-quality", "95", converted).CombinedOutput(); err != nil {
+			return fmt.Errorf("magick: %w: %s", err, output)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func init() {
+	adminEndpoints["metrics"] = adminEndpoint{handler: promhttp.Handler().ServeHTTP}
+}
+
+var (
+	metricUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iuo_uploads_total",
+		Help: "Uploads received, by result: optimized (processed file uploaded), original (original uploaded) or failed",
+	}, []string{"result"})
+	metricBytesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iuo_task_bytes_in_total",
+		Help: "Size of the original files processed by each task",
+	}, []string{"task"})
+	metricBytesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iuo_task_bytes_out_total",
+		Help: "Size of the files uploaded to immich for the originals processed by each task, original or processed",
+	}, []string{"task"})
+	metricTaskRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iuo_task_runs_total",
+		Help: "Task runs",
+	}, []string{"task"})
+	metricTaskFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iuo_task_failures_total",
+		Help: "Task runs that failed",
+	}, []string{"task"})
+	metricTaskDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "iuo_task_duration_seconds",
+		Help:    "Task run duration, not counting the wait for a free job slot",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 16),
+	}, []string{"task"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "iuo_jobs_running",
+		Help:        "Jobs holding a slot of max_image_jobs/max_video_jobs/max_download_jobs",
+		ConstLabels: prometheus.Labels{"class": "image"},
+	}, func() float64 { return float64(len(imageSemaphore)) })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "iuo_jobs_running",
+		Help:        "Jobs holding a slot of max_image_jobs/max_video_jobs/max_download_jobs",
+		ConstLabels: prometheus.Labels{"class": "video"},
+	}, func() float64 { return float64(len(videoSemaphore)) })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "iuo_jobs_running",
+		Help:        "Jobs holding a slot of max_image_jobs/max_video_jobs/max_download_jobs",
+		ConstLabels: prometheus.Labels{"class": "download"},
+	}, func() float64 { return float64(len(downloadSemaphore)) })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "iuo_websockets_active",
+		Help: "Websocket connections being proxied, limited by max_websockets",
+	}, func() float64 { return float64(activeWebSockets.Load()) })
+)
+
+func observeTaskRun(task string, duration time.Duration, err error) {
+	metricTaskRuns.WithLabelValues(task).Inc()
+	metricTaskDuration.WithLabelValues(task).Observe(duration.Seconds())
+	if err != nil {
+		metricTaskFailures.WithLabelValues(task).Inc()
+	}
+}
+
+// observeUpload taskProcessor nil when no task processed the file
+func observeUpload(taskProcessor *TaskProcessor, uploadedProcessed bool, uploadedSize int64, err error) {
+	switch {
+	case err != nil:
+		metricUploads.WithLabelValues("failed").Inc()
+		return
+	case uploadedProcessed:
+		metricUploads.WithLabelValues("optimized").Inc()
+	default:
+		metricUploads.WithLabelValues("original").Inc()
+	}
+	if taskProcessor != nil {
+		metricBytesIn.WithLabelValues(taskProcessor.Task.Name).Add(float64(taskProcessor.OriginalSize))
+		metricBytesOut.WithLabelValues(taskProcessor.Task.Name).Add(float64(uploadedSize))
+	}
+}
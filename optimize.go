@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// runOptimize processes a local file with the tasks file like an upload, without starting the server. Returns the process exit code.
+// The processed file is left in its temp folder to be inspected
+func runOptimize(filePath string) int {
+	var err error
+	if runAsFlag != "" {
+		if runAsGlobal, err = parseCommandUser(runAsFlag); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	c, err := NewConfig(&configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	config.Store(c)
+	imageSemaphore = make(chan struct{}, 1)
+	videoSemaphore = make(chan struct{}, 1)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	taskProcessor, err := newTaskProcessor(context.Background(), file, filepath.Base(filePath), stat.Size(), 0, "")
+	if err != nil {
+		fmt.Printf("not processed: %v\n", err)
+		return 1
+	}
+	defer taskProcessor.CleanOriginalFile()
+	taskProcessor.SetLogger(newCustomLogger(newBaseLogger(), "optimize: "))
+	fmt.Printf("task: %s\n", taskProcessor.Task.Name)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err = taskProcessor.Run(ctx); err != nil {
+		fmt.Printf("task failed, the original would be uploaded: %v\n", err)
+		_ = taskProcessor.CleanWorkDir()
+		return 1
+	}
+	_ = taskProcessor.ProcessedFile.Close()
+	fmt.Printf("original: %s (%s)\n", filePath, humanReadableSize(taskProcessor.OriginalSize))
+	fmt.Printf("processed: %s (%s)\n", taskProcessor.ProcessedFile.Name(), humanReadableSize(taskProcessor.ProcessedSize))
+	if taskProcessor.KeepPolicy.keepProcessed(taskProcessor.OriginalSize, taskProcessor.ProcessedSize) {
+		fmt.Printf("the processed file would be uploaded as %s\n", taskProcessor.ProcessedFilename)
+	} else {
+		fmt.Println("the original would be uploaded, the processed file doesn't satisfy the keep policy")
+	}
+	return 0
+}
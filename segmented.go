@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultSegmentDuration = 60
+
+// runSegmented splits the video in segments, runs the task command on them in parallel and joins the results in the work dir
+func (tp *TaskProcessor) runSegmented(ctx context.Context, inputPath string) error {
+	segmentsDir, err := os.MkdirTemp(tp.Task.TempDir, "segments-*")
+	if err != nil {
+		return fmt.Errorf("unable to create temp folder: %w", err)
+	}
+	defer os.RemoveAll(segmentsDir)
+	if user := tp.Task.runAsUser(); user != nil {
+		// ffmpeg runs as the user too: it splits the original in segmentsDir and joins the segments in the work dir
+		if err = user.own(inputPath, segmentsDir, tp.tempWorkDir); err != nil {
+			return fmt.Errorf("unable to give files to run_as user: %w", err)
+		}
+	}
+
+	extension := path.Ext(inputPath)
+	tp.debugf("splitting in %ds segments: %s", tp.Task.segmentDuration(), tp.Task.Name)
+	if err = tp.runFFmpeg(ctx, "-i", inputPath, "-map", "0:v:0", "-map", "0:a?", "-c", "copy", "-f", "segment",
+		"-segment_time", strconv.FormatUint(uint64(tp.Task.segmentDuration()), 10), "-reset_timestamps", "1",
+		path.Join(segmentsDir, "segment-%05d"+extension)); err != nil {
+		return fmt.Errorf("unable to split video: %w", err)
+	}
+	segments, err := os.ReadDir(segmentsDir)
+	if err != nil {
+		return fmt.Errorf("unable to read segments directory: %w", err)
+	}
+	if len(segments) == 0 {
+		return fmt.Errorf("splitting the video produced no segments")
+	}
+
+	// Each segment gets its own result folder, the command must create only 1 file in it like for a normal task
+	outputs := make([]string, len(segments))
+	// The first failure cancels the other segments, the task failed anyway
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(int(tp.Task.segmentJobs()))
+	for i, segment := range segments {
+		group.Go(func() (err error) {
+			if outputs[i], err = tp.encodeSegment(groupCtx, path.Join(segmentsDir, segment.Name())); err != nil {
+				return fmt.Errorf("segment %d/%d failed: %w", i+1, len(segments), err)
+			}
+			return nil
+		})
+	}
+	if err = group.Wait(); err != nil {
+		return err
+	}
+
+	var list strings.Builder
+	for _, output := range outputs {
+		_, _ = fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(output, "'", `'\''`))
+	}
+	listPath := path.Join(segmentsDir, "concat.txt")
+	if err = os.WriteFile(listPath, []byte(list.String()), 0600); err != nil {
+		return fmt.Errorf("unable to write concat list: %w", err)
+	}
+	outputPath := path.Join(tp.tempWorkDir, strings.TrimSuffix(path.Base(inputPath), extension)+path.Ext(outputs[0]))
+	tp.debugf("joining %d segments: %s", len(segments), tp.Task.Name)
+	// The original is the second input only to keep its metadata (e.g. creation date)
+	if err = tp.runFFmpeg(ctx, "-f", "concat", "-safe", "0", "-i", listPath, "-i", inputPath, "-map", "0", "-map_metadata", "1", "-c", "copy", outputPath); err != nil {
+		return fmt.Errorf("unable to join segments: %w", err)
+	}
+	return tp.verifyJoinedDuration(ctx, inputPath, outputPath)
+}
+
+func (tp *TaskProcessor) encodeSegment(ctx context.Context, segmentPath string) (string, error) {
+	resultDir := strings.TrimSuffix(segmentPath, path.Ext(segmentPath))
+	if err := os.Mkdir(resultDir, 0700); err != nil {
+		return "", fmt.Errorf("unable to create segment folder: %w", err)
+	}
+	if err := tp.runSteps(ctx, "segment", segmentPath, resultDir); err != nil {
+		return "", err
+	}
+	files, err := os.ReadDir(resultDir)
+	if err != nil {
+		return "", fmt.Errorf("unable to read segment folder: %w", err)
+	}
+	if len(files) != 1 {
+		return "", fmt.Errorf("unexpected number of files in segment folder: %d", len(files))
+	}
+	return path.Join(resultDir, files[0].Name()), nil
+}
+
+// verifyJoinedDuration makes sure the joined file is readable and no segment went missing
+func (tp *TaskProcessor) verifyJoinedDuration(ctx context.Context, inputPath, outputPath string) error {
+	inputDuration, err := tp.videoDuration(ctx, inputPath)
+	if err != nil {
+		return fmt.Errorf("unable to read original duration: %w", err)
+	}
+	outputDuration, err := tp.videoDuration(ctx, outputPath)
+	if err != nil {
+		return fmt.Errorf("joined video is invalid: %w", err)
+	}
+	// Segments are cut on keyframes, allow some rounding
+	if tolerance := max(1, inputDuration/100); math.Abs(inputDuration-outputDuration) > tolerance {
+		return fmt.Errorf("joined video duration doesn't match the original: %.2fs != %.2fs", outputDuration, inputDuration)
+	}
+	return nil
+}
+
+func (tp *TaskProcessor) videoDuration(ctx context.Context, file string) (float64, error) {
+	output, err := tp.runTool(ctx, ffprobePath, "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(output), 64)
+}
+
+func (tp *TaskProcessor) runFFmpeg(ctx context.Context, args ...string) error {
+	_, err := tp.runTool(ctx, ffmpegPath, append([]string{"-hide_banner", "-loglevel", "error", "-y"}, args...)...)
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// segmentRunner stands for ffmpeg, ffprobe and a task command whose command line is {{.name}} {{.result_folder}}.
+// With failing set, the command fails on that segment and waits to be cancelled on the other ones
+type segmentRunner struct {
+	failing   string
+	cancelled *atomic.Int32
+}
+
+func (runner segmentRunner) Run(ctx context.Context, dir, cmdLine string, user *commandUser, stdout, stderr io.Writer) error {
+	args, err := splitCommandLine(cmdLine)
+	if err != nil {
+		return err
+	}
+	last := args[len(args)-1]
+	switch {
+	case args[0] == ffmpegPath && slices.Contains(args, "segment"):
+		// The last argument is the pattern of the segment files
+		for i := range 4 {
+			if err = os.WriteFile(fmt.Sprintf(last, i), []byte("segment"), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	case args[0] == ffmpegPath:
+		return os.WriteFile(last, []byte("joined"), 0644)
+	case args[0] == ffprobePath:
+		_, err = io.WriteString(stdout, "10.0\n")
+		return err
+	case runner.failing == "":
+		return os.WriteFile(filepath.Join(last, args[0]+".avif"), []byte("encoded"), 0644)
+	case args[0] == runner.failing:
+		return errors.New("encoder crashed")
+	}
+	<-ctx.Done()
+	runner.cancelled.Add(1)
+	return ctx.Err()
+}
+
+func newSegmentedTaskProcessor(t *testing.T, runner segmentRunner) *TaskProcessor {
+	t.Helper()
+	task := &Task{Name: "segments", Extensions: []string{"mp4"}, Command: "{{.name}} {{.result_folder}}", Segmented: true, SegmentJobs: 4}
+	taskProcessor := newTestTaskProcessor(t, task, "clip.mp4", []byte("mp4"))
+	taskProcessor.Runner = runner
+	return taskProcessor
+}
+
+func TestRunSegmented(t *testing.T) {
+	taskProcessor := newSegmentedTaskProcessor(t, segmentRunner{})
+	if err := taskProcessor.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if taskProcessor.ProcessedFilename != "clip.avif" || taskProcessor.ProcessedSize != int64(len("joined")) {
+		t.Errorf("processed %s (%d bytes), want the joined clip.avif", taskProcessor.ProcessedFilename, taskProcessor.ProcessedSize)
+	}
+}
+
+func TestRunSegmentedFailureCancelsSegments(t *testing.T) {
+	var cancelled atomic.Int32
+	taskProcessor := newSegmentedTaskProcessor(t, segmentRunner{failing: "segment-00002", cancelled: &cancelled})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := taskProcessor.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "segment 3/4 failed") || !strings.Contains(err.Error(), "encoder crashed") {
+		t.Fatalf("err = %v, want segment 3/4 failed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Run returned after %s, the other segments weren't cancelled", elapsed)
+	}
+	if got := cancelled.Load(); got != 3 {
+		t.Errorf("%d segments cancelled, want 3", got)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const streamPollInterval = 100 * time.Millisecond
+
+// RunStreamed runs the task while upload sends its output file as it's being written.
+// The stream only reaches EOF once the command succeeded and the bytes sent match the final file, otherwise it fails the upload.
+// Returns the upstream response and the SHA1 of the uploaded file
+func (tp *TaskProcessor) RunStreamed(ctx context.Context, upload func(stream io.ReadSeeker, name string) (*http.Response, error)) (*http.Response, string, error) {
+	var err error
+	if tp.tempWorkDir, err = os.MkdirTemp(tp.Task.TempDir, "processing-*"); err != nil {
+		return nil, "", fmt.Errorf("unable to create temp folder: %w", err)
+	}
+	done := make(chan struct{})
+	var runErr error
+	go func() {
+		defer close(done)
+		runErr = tp.Run(ctx)
+	}()
+	// Wait for the command to create its output file
+	var outputPath string
+	for outputPath == "" {
+		files, err := os.ReadDir(tp.tempWorkDir)
+		if err != nil {
+			<-done
+			return nil, "", fmt.Errorf("unable to read temp directory: %w", err)
+		}
+		if len(files) > 0 {
+			outputPath = path.Join(tp.tempWorkDir, files[0].Name())
+			break
+		}
+		select {
+		case <-done:
+			if runErr == nil {
+				runErr = errors.New("command exited without creating an output file")
+			}
+			return nil, "", runErr
+		case <-time.After(streamPollInterval):
+		}
+	}
+	// Nothing is sent for an output that would be rejected once the command is done
+	if err = tp.Task.checkOutputExtension(outputPath); err != nil {
+		<-done
+		return nil, "", err
+	}
+	outputFile, err := os.Open(outputPath)
+	if err != nil {
+		<-done
+		return nil, "", fmt.Errorf("unable to open output file: %w", err)
+	}
+	defer outputFile.Close()
+	stream := &tailReader{file: outputFile, done: done, runErr: &runErr, hasher: sha1.New()}
+	name := strings.TrimSuffix(tp.OriginalFilename, tp.OriginalExtension) + path.Ext(outputPath)
+	tp.debugf("streaming upload: %s", name)
+	resp, err := upload(stream, name)
+	<-done
+	if err == nil && runErr != nil {
+		// Upstream answered before the stream ended
+		resp.Body.Close()
+		err = runErr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if tp.ProcessedFile == nil || tp.ProcessedFile.Name() != outputPath {
+		resp.Body.Close()
+		return nil, "", errors.New("streamed file isn't the task output")
+	}
+	return resp, base64.StdEncoding.EncodeToString(stream.hasher.Sum(nil)), nil
+}
+
+// tailReader reads a file while another process is still appending to it
+type tailReader struct {
+	file   *os.File
+	done   <-chan struct{}
+	runErr *error // Only read after done is closed
+	hasher hash.Hash
+	read   int64
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.file.Read(p)
+		if n > 0 {
+			t.hasher.Write(p[:n])
+			t.read += int64(n)
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		select {
+		case <-t.done:
+			// Anything written after the last read and before exiting
+			if n, _ = t.file.Read(p); n > 0 {
+				t.hasher.Write(p[:n])
+				t.read += int64(n)
+				return n, nil
+			}
+			if *t.runErr != nil {
+				return 0, *t.runErr
+			}
+			return 0, t.verify()
+		case <-time.After(streamPollInterval):
+		}
+	}
+}
+
+// verify detects commands that went back and rewrote parts of the file already sent
+func (t *tailReader) verify() error {
+	finalHash, err := SHA1(t.file)
+	if err != nil {
+		return err
+	}
+	if finalHash != base64.StdEncoding.EncodeToString(t.hasher.Sum(nil)) {
+		return errors.New("output file was modified after being streamed, the command must only append to it")
+	}
+	return io.EOF
+}
+
+// Seek only supports the initial rewind done before uploading
+func (t *tailReader) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart && t.read == 0 {
+		return 0, nil
+	}
+	return 0, errors.New("a streamed file can't be rewound")
+}
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"os"
 	"os/exec"
 	"path"
-	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/google/shlex"
+	"golang.org/x/sync/semaphore"
 )
 
+// commandWaitDelay how long to wait for the output pipes to close after a command was killed
+const commandWaitDelay = 5 * time.Second
+
 type TaskProcessor struct {
 	Task              *Task
 	OriginalFile      *os.File
@@ -27,74 +40,252 @@ type TaskProcessor struct {
 	ProcessedExtension string
 	ProcessedSize      int64
 
+	// CommandStdout stdout of the task command, only kept when the task has separate_output
+	CommandStdout string
+
+	// KeepPolicy captured with the task, a config reload doesn't change it
+	KeepPolicy KeepPolicy
+
+	// Runner runs the task commands, nil uses sh
+	Runner CommandRunner
+
+	// JobID and UploadTime are available to the command templates
+	JobID      int64
+	UploadTime time.Time
+
 	tempWorkDir string
+	// gpuDevices of the config when the upload was received, gpuDevice the one picked by Run
+	gpuDevices []string
+	gpuDevice  string
+	// fileExtension of the temp original file, the detected one when the task was matched on the MIME type
+	fileExtension string
+	// releaseInflightBytes gives back the max_inflight_bytes reserved for the job, nil once done
+	releaseInflightBytes func()
 
 	logger *customLogger
 }
 
-func NewTaskProcessorFromMultipart(file multipart.File, header *multipart.FileHeader) (*TaskProcessor, error) {
-	originalExtension := path.Ext(header.Filename)
+// NewTaskProcessorFromMultipart declaredSize and checksum (SHA1 in base64) are the ones sent by the client, 0/empty if unknown.
+// ctx cancels the wait for max_inflight_bytes
+func NewTaskProcessorFromMultipart(ctx context.Context, file multipart.File, header *multipart.FileHeader, declaredSize int64, checksum string) (*TaskProcessor, error) {
+	return newTaskProcessor(ctx, file, header.Filename, header.Size, declaredSize, checksum)
+}
+
+// inflightBytes budget of max_inflight_bytes shared by the jobs, nil when unlimited
+var inflightBytes *semaphore.Weighted
+
+// reserveInflightBytes waits until size fits in max_inflight_bytes. An upload bigger than the whole budget waits for all of it, it runs alone
+func reserveInflightBytes(ctx context.Context, size int64) (release func(), err error) {
+	if inflightBytes == nil || size <= 0 {
+		return func() {}, nil
+	}
+	size = min(size, int64(maxInflightBytes))
+	if err = inflightBytes.Acquire(ctx, size); err != nil {
+		return nil, fmt.Errorf("waiting for max_inflight_bytes: %w", err)
+	}
+	return func() { inflightBytes.Release(size) }, nil
+}
+
+// errCorruptUpload the copied upload doesn't match its size or checksum, e.g. the client dropped mid-stream
+var errCorruptUpload = errors.New("corrupt upload")
+
+// newTaskProcessor size is the one of file, 0 if unknown. The file is copied to a temp file, verified against
+// declaredSize (announced by the client, 0 to skip it) and checksum (SHA1 in base64, empty to skip it)
+func newTaskProcessor(ctx context.Context, file multipart.File, filename string, size, declaredSize int64, checksum string) (*TaskProcessor, error) {
+	// min_filesize/max_filesize are checked before copying, the copy of a file too big for a tmpfs must not even start
+	if size <= 0 {
+		size = declaredSize
+	}
+	originalExtension := path.Ext(filename)
+	if originalExtension == "" {
+		if !detectMissingExtension {
+			return nil, fmt.Errorf("no file extension")
+		}
+		signature, ok := sniffFileType(file)
+		if !ok {
+			return nil, fmt.Errorf("no file extension and unknown file type")
+		}
+		originalExtension = "." + signature.extension
+	}
 	if !isValidFilename(originalExtension) {
 		return nil, fmt.Errorf("invalid file extension: %s", originalExtension)
 	}
 
 	// Must have a task, passthrough the request to immich otherwise
 	checkExt := strings.ToLower(strings.TrimPrefix(originalExtension, "."))
-	var task *Task
-	for _, t := range config.Tasks {
-		if slices.Contains(t.Extensions, checkExt) {
-			task = t
-			break
+	currentConfig := config.Load()
+	task, err := currentConfig.taskForExtension(checkExt, size)
+	// How the task was found, to find it again once the size is known
+	matches := matchesExtension(checkExt)
+	// Extension of the temp file, also decides if it's an image or a video
+	fileExtension := originalExtension
+	if task == nil || detectMime {
+		// A task matching the detected type wins over the extension, which may be wrong
+		if signature, ok := sniffFileType(file); ok {
+			if mimeTask, mimeErr := currentConfig.taskForMimeType(signature.mimeType, size); mimeTask != nil {
+				task = mimeTask
+				matches = matchesMimeType(signature.mimeType)
+				fileExtension = "." + signature.extension
+			} else if task == nil && mimeErr != nil {
+				err = mimeErr
+			}
 		}
 	}
 	if task == nil {
+		if err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("no task found for file extension .%s", checkExt)
 	}
+	if isImageExtension(fileExtension) && disableImageJobs {
+		return nil, fmt.Errorf("image processing is disabled")
+	}
+	if !isImageExtension(fileExtension) && disableVideoJobs {
+		return nil, fmt.Errorf("video processing is disabled")
+	}
 
-	if header.Size < task.MinFilesizeBytes {
-		return nil, fmt.Errorf("file size is smaller than minimum: %d < %d", header.Size, task.MinFilesizeBytes)
+	if minWidth, minHeight := task.minDimensions(); minWidth > 0 || minHeight > 0 {
+		if width, height, ok := imageDimensions(file); ok && (width < minWidth || height < minHeight) {
+			return nil, fmt.Errorf("image dimensions are smaller than minimum: %dx%d < %dx%d", width, height, minWidth, minHeight)
+		}
 	}
 
-	originalFile, err := os.CreateTemp("", "upload-*"+originalExtension)
+	if size > 0 {
+		if err := checkFreeSpace(task.TempDir, size); err != nil {
+			return nil, err
+		}
+	}
+
+	releaseInflightBytes, err := reserveInflightBytes(ctx, size)
+	if err != nil {
+		return nil, err
+	}
+	originalFile, err := os.CreateTemp(task.TempDir, "upload-*"+fileExtension)
 	if err != nil {
+		releaseInflightBytes()
 		return nil, fmt.Errorf("unable to create temp file: %w", err)
 	}
+	// Until the TaskProcessor owning it is returned, also on panic
+	keepOriginalFile := false
+	defer func() {
+		if !keepOriginalFile {
+			_ = originalFile.Close()
+			_ = os.Remove(originalFile.Name())
+			releaseInflightBytes()
+		}
+	}()
 
-	_, err = io.Copy(originalFile, file)
+	hasher := sha1.New()
+	var copyWriter io.Writer = originalFile
+	if checksum != "" {
+		copyWriter = io.MultiWriter(originalFile, hasher)
+	}
+	// Stops right after max_filesize, whatever size was announced. Without a size, any matching task may end up with the file
+	maxFilesize := task.MaxFilesizeBytes
+	if size <= 0 {
+		maxFilesize = currentConfig.maxFilesize(matches)
+	}
+	var copyReader io.Reader = file
+	if maxFilesize > 0 {
+		copyReader = io.LimitReader(file, maxFilesize+1)
+	}
+	originalSize, err := io.Copy(copyWriter, copyReader)
 	if err != nil {
 		return nil, fmt.Errorf("unable to write temp file: %w", err)
 	}
+	if maxFilesize > 0 && originalSize > maxFilesize {
+		return nil, fmt.Errorf("file size is bigger than maximum: more than %d bytes", maxFilesize)
+	}
+	if size <= 0 {
+		// Picked without checking its size limits, a later task may be the one accepting it
+		if task, err = currentConfig.firstTask(originalSize, matches); task == nil {
+			return nil, err
+		}
+	}
+	// The multipart parser only sees the bytes that arrived, a client dropping mid-stream is only caught by what it announced
+	if declaredSize > 0 && originalSize != declaredSize {
+		return nil, fmt.Errorf("%w: %d bytes received, %d announced", errCorruptUpload, originalSize, declaredSize)
+	}
+	if checksum != "" {
+		if received := base64.StdEncoding.EncodeToString(hasher.Sum(nil)); received != checksum {
+			return nil, fmt.Errorf("%w: checksum %s of the received file isn't the announced %s", errCorruptUpload, received, checksum)
+		}
+	}
+	if err = task.checkFilesize(originalSize); err != nil {
+		return nil, err
+	}
 
+	keepOriginalFile = true
 	return &TaskProcessor{
 		Task:                 task,
 		OriginalFile:         originalFile,
-		OriginalFilename:     header.Filename,
+		OriginalFilename:     filename,
 		OriginalExtension:    originalExtension,
-		OriginalSize:         header.Size,
+		OriginalSize:         originalSize,
+		KeepPolicy:           currentConfig.keepPolicy(task, fileExtension),
+		UploadTime:           time.Now(),
+		gpuDevices:           currentConfig.GPUDevices,
 		tempOriginalFilePath: originalFile.Name(),
+		fileExtension:        fileExtension,
+		releaseInflightBytes: releaseInflightBytes,
 	}, nil
 }
 
+var errNotEnoughSpace = errors.New("not enough free space")
+
+// checkFreeSpace the temp folder needs room for the copy of the upload and for the processed file, estimated as big as the upload.
+// Fails before copying instead of in the middle of a command. Unknown free space isn't an error
+func checkFreeSpace(dir string, size int64) error {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if needed := uint64(size) * 2; free < needed {
+		return fmt.Errorf("%w in %s: %s free, %s needed", errNotEnoughSpace, dir, humanReadableSize(int64(free)), humanReadableSize(int64(needed)))
+	}
+	return nil
+}
+
 func (tp *TaskProcessor) SetLogger(logger *customLogger) {
 	tp.logger = logger
 }
 
-func (tp *TaskProcessor) logf(str string, args ...interface{}) {
+func (tp *TaskProcessor) infof(str string, args ...interface{}) {
+	if tp.logger != nil {
+		tp.logger.Infof(str, args...)
+	}
+}
+
+func (tp *TaskProcessor) debugf(str string, args ...interface{}) {
+	if tp.logger != nil {
+		tp.logger.Debugf(str, args...)
+	}
+}
+
+func (tp *TaskProcessor) warnf(str string, args ...interface{}) {
 	if tp.logger != nil {
-		tp.logger.Printf(str, args...)
+		tp.logger.Warnf(str, args...)
 	}
 }
 
 func (tp *TaskProcessor) Close() error {
 	_ = tp.CleanOriginalFile()
-	return tp.CleanWorkDir()
+	err := tp.CleanWorkDir()
+	if tp.releaseInflightBytes != nil {
+		tp.releaseInflightBytes()
+		tp.releaseInflightBytes = nil
+	}
+	return err
 }
 
 func (tp *TaskProcessor) CleanOriginalFile() (err error) {
 	if tp.OriginalFile != nil {
 		err = tp.OriginalFile.Close()
 		if err != nil {
-			tp.logf("unable to close original file: %v", err)
+			tp.warnf("unable to close original file: %v", err)
 		}
 		tp.OriginalFile = nil
 	}
@@ -102,7 +293,7 @@ func (tp *TaskProcessor) CleanOriginalFile() (err error) {
 	if tp.tempOriginalFilePath != "" {
 		err = os.Remove(tp.tempOriginalFilePath)
 		if err != nil {
-			tp.logf("unable to remove temp file: %v", err)
+			tp.warnf("unable to remove temp file: %v", err)
 		}
 		tp.tempOriginalFilePath = ""
 	}
@@ -115,49 +306,55 @@ func (tp *TaskProcessor) CleanWorkDir() error {
 	}
 	err := os.RemoveAll(tp.tempWorkDir)
 	if err != nil {
-		tp.logf("unable to clean temp folder: %v", err)
+		tp.warnf("unable to clean temp folder: %v", err)
 	}
 	tp.tempWorkDir = ""
 	return err
 }
 
-func (tp *TaskProcessor) Run() error {
+// gpuDeviceCounter spreads the jobs over gpu_devices in turn
+var gpuDeviceCounter atomic.Uint64
+
+// Run ctx cancels the commands, e.g. when the client disconnected
+func (tp *TaskProcessor) Run(ctx context.Context) (err error) {
 	// Limit the number of concurrent tasks running
-	if slices.Contains(imageExtensions, strings.ToLower(strings.TrimPrefix(tp.OriginalExtension, "."))) {
-		imageSemaphore <- struct{}{}
-		defer func() { <-imageSemaphore }()
-	} else {
-		videoSemaphore <- struct{}{}
-		defer func() { <-videoSemaphore }()
+	semaphore, queued := videoSemaphore, &videoJobsQueued
+	if isImageExtension(tp.fileExtension) {
+		semaphore, queued = imageSemaphore, &imageJobsQueued
 	}
-	var err error
-
-	tp.tempWorkDir, err = os.MkdirTemp("", "processing-*")
-	if err != nil {
-		return fmt.Errorf("unable to create temp folder: %w", err)
+	if err = acquireJobSlot(ctx, semaphore, queued); err != nil {
+		return err
 	}
+	defer func() { <-semaphore }()
+	if len(tp.gpuDevices) > 0 {
+		tp.gpuDevice = tp.gpuDevices[(gpuDeviceCounter.Add(1)-1)%uint64(len(tp.gpuDevices))]
+		tp.infof("%s: gpu device %s", tp.Task.Name, tp.gpuDevice)
+	}
+	start := time.Now()
+	defer func() { observeTaskRun(tp.Task.Name, time.Since(start), err) }()
 
-	basename := path.Base(tp.tempOriginalFilePath)
-	extension := path.Ext(basename)
-	values := map[string]string{
-		"result_folder": tp.tempWorkDir,
-		"original_name": base64.StdEncoding.EncodeToString([]byte(tp.OriginalFilename)),
-		"folder":        path.Dir(tp.tempOriginalFilePath),
-		"name":          strings.TrimSuffix(basename, extension),
-		"extension":     strings.TrimPrefix(extension, "."),
+	// Already created when streaming
+	if tp.tempWorkDir == "" {
+		if tp.tempWorkDir, err = os.MkdirTemp(tp.Task.TempDir, "processing-*"); err != nil {
+			return fmt.Errorf("unable to create temp folder: %w", err)
+		}
 	}
 
-	var cmdLine bytes.Buffer
-	err = tp.Task.CommandTemplate.Execute(&cmdLine, values)
-	if err != nil {
-		return fmt.Errorf("unable to generate command to be Run: %w", err)
+	inputPath := tp.tempOriginalFilePath
+	if tp.Task.PreprocessTemplate != nil {
+		// The preprocess output replaces the original as input of the task command, the original is kept for fallback
+		preprocessDir, err := os.MkdirTemp(tp.Task.TempDir, "preprocessing-*")
+		if err != nil {
+			return fmt.Errorf("unable to create temp folder: %w", err)
+		}
+		defer os.RemoveAll(preprocessDir)
+		if inputPath, err = tp.runToSingleFile(ctx, "preprocess", tp.Task.PreprocessTemplate, inputPath, preprocessDir); err != nil {
+			return fmt.Errorf("preprocess failed: %w", err)
+		}
 	}
-	tp.logf("running task: %s: %s", tp.Task.Name, cmdLine.String())
-	cmd := exec.Command("sh", "-c", cmdLine.String())
-	cmd.Dir = path.Dir(configFile)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%w while running command:\n%s\nOutput:\n%s", err, cmdLine.String(), string(output))
+
+	if err = tp.runWithRetries(ctx, inputPath); err != nil {
+		return err
 	}
 
 	files, err := os.ReadDir(tp.tempWorkDir)
@@ -170,13 +367,30 @@ func (tp *TaskProcessor) Run() error {
 	}
 
 	processedFilePath := path.Join(tp.tempWorkDir, files[0].Name())
-	tp.ProcessedFile, err = os.Open(processedFilePath)
-	if err != nil {
-		return fmt.Errorf("unable to open temp file: %w", err)
+	if err = tp.Task.checkOutputExtension(processedFilePath); err != nil {
+		return err
+	}
+	if tp.Task.PreserveMetadata {
+		if err = tp.copyMetadata(ctx, tp.tempOriginalFilePath, processedFilePath); err != nil {
+			tp.warnf("unable to copy metadata of the original, keeping the processed file without it: %v", err)
+		}
 	}
 	stat, err := os.Stat(processedFilePath)
 	if err != nil {
-		err = fmt.Errorf("unable to get file size: %w", err)
+		return fmt.Errorf("unable to get file size: %w", err)
+	}
+	// A killed command can exit 0 without writing anything
+	if stat.Size() == 0 {
+		return errors.New("processed file is empty")
+	}
+	if tp.Task.VerifyTemplate != nil {
+		if err = tp.runCommand(ctx, "verify", tp.Task.VerifyTemplate, processedFilePath, tp.tempWorkDir); err != nil {
+			return fmt.Errorf("processed file verification failed: %w", err)
+		}
+	}
+	tp.ProcessedFile, err = os.Open(processedFilePath)
+	if err != nil {
+		return fmt.Errorf("unable to open temp file: %w", err)
 	}
 	tp.ProcessedSize = stat.Size()
 	tp.ProcessedExtension = path.Ext(processedFilePath)
@@ -184,3 +398,344 @@ func (tp *TaskProcessor) Run() error {
 
 	return nil
 }
+
+// runWithRetries runs the task command, again after a failure up to retries times, e.g. for a hardware encoder transiently busy.
+// The delay between the attempts doubles each time. Not retried when streaming: the output is already being uploaded
+func (tp *TaskProcessor) runWithRetries(ctx context.Context, inputPath string) (err error) {
+	retries := tp.Task.Retries
+	if tp.Task.StreamUpload {
+		retries = 0
+	}
+	delay := tp.Task.RetryDelay
+	for attempt := uint(0); ; attempt++ {
+		if tp.Task.Segmented {
+			err = tp.runSegmented(ctx, inputPath)
+		} else {
+			err = tp.runSteps(ctx, "task", inputPath, tp.tempWorkDir)
+		}
+		if err == nil || attempt == retries || ctx.Err() != nil {
+			return err
+		}
+		tp.warnf("%s: attempt %d/%d failed, retrying in %s: %v", tp.Task.Name, attempt+1, retries+1, delay, err)
+		// The next attempt must start from an empty work dir, a single file is expected in it
+		if err = clearDir(tp.tempWorkDir); err != nil {
+			return fmt.Errorf("unable to clean temp folder before retrying: %w", err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// clearDir removes the content of dir, keeping dir
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.RemoveAll(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyMetadata copies the tags of the original (e.g. capture date, GPS) dropped by some encoders
+func (tp *TaskProcessor) copyMetadata(ctx context.Context, original, processed string) error {
+	if user := tp.Task.runAsUser(); user != nil {
+		// exiftool writes the tagged copy next to the processed file, then replaces it
+		if err := user.own(original, processed, path.Dir(processed)); err != nil {
+			return fmt.Errorf("unable to give files to run_as user: %w", err)
+		}
+	}
+	_, err := tp.runTool(ctx, exiftoolPath, "-q", "-overwrite_original", "-TagsFromFile", original, processed)
+	return err
+}
+
+// runSteps runs the task commands in sequence, each one processing the file created by the previous one. Only the last one writes in resultFolder
+func (tp *TaskProcessor) runSteps(ctx context.Context, kind, inputPath, resultFolder string) error {
+	steps := tp.Task.CommandTemplates
+	previousDir := ""
+	// Intermediate files are deleted as soon as the next command is done with them
+	defer func() { _ = os.RemoveAll(previousDir) }()
+	for i, step := range steps[:len(steps)-1] {
+		stepDir, err := os.MkdirTemp(tp.Task.TempDir, "step-*")
+		if err != nil {
+			return fmt.Errorf("unable to create temp folder: %w", err)
+		}
+		inputPath, err = tp.runToSingleFile(ctx, fmt.Sprintf("%s step %d/%d", kind, i+1, len(steps)), step, inputPath, stepDir)
+		_ = os.RemoveAll(previousDir)
+		previousDir = stepDir
+		if err != nil {
+			return err
+		}
+	}
+	if len(steps) > 1 {
+		kind = fmt.Sprintf("%s step %d/%d", kind, len(steps), len(steps))
+	}
+	return tp.runCommand(ctx, kind, steps[len(steps)-1], inputPath, resultFolder)
+}
+
+// runToSingleFile runs the command and returns the only file it must have created in resultFolder
+func (tp *TaskProcessor) runToSingleFile(ctx context.Context, kind string, commandTemplate *template.Template, inputPath, resultFolder string) (string, error) {
+	if err := tp.runCommand(ctx, kind, commandTemplate, inputPath, resultFolder); err != nil {
+		return "", err
+	}
+	files, err := os.ReadDir(resultFolder)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s temp directory: %w", kind, err)
+	}
+	if len(files) != 1 {
+		return "", fmt.Errorf("unexpected number of files in %s temp directory: %d", kind, len(files))
+	}
+	return path.Join(resultFolder, files[0].Name()), nil
+}
+
+// CommandRunner runs a command line in dir as user (nil: IUO's user). Tests can replace it to run without the real tools
+type CommandRunner interface {
+	Run(ctx context.Context, dir, cmdLine string, user *commandUser, stdout, stderr io.Writer) error
+}
+
+// shellRunner the default CommandRunner
+type shellRunner struct{}
+
+func (shellRunner) Run(ctx context.Context, dir, cmdLine string, user *commandUser, stdout, stderr io.Writer) error {
+	return runExecCommand(exec.CommandContext(ctx, "sh", "-c", cmdLine), dir, user, stdout, stderr)
+}
+
+// directRunner runs tasks with shell: false. The command line is split into arguments like sh would, without pipes, redirections or variables
+type directRunner struct{}
+
+func (directRunner) Run(ctx context.Context, dir, cmdLine string, user *commandUser, stdout, stderr io.Writer) error {
+	args, err := splitCommandLine(cmdLine)
+	if err != nil {
+		return err
+	}
+	return runExecCommand(exec.CommandContext(ctx, args[0], args[1:]...), dir, user, stdout, stderr)
+}
+
+func splitCommandLine(cmdLine string) ([]string, error) {
+	args, err := shlex.Split(cmdLine)
+	if err != nil {
+		return nil, fmt.Errorf("unable to split command line: %v", err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command line")
+	}
+	return args, nil
+}
+
+func runExecCommand(cmd *exec.Cmd, dir string, user *commandUser, stdout, stderr io.Writer) error {
+	cmd.Dir = dir
+	// Kill the children too (e.g. ffmpeg started by a script), they would keep running and hold the output pipes open
+	killProcessGroupOnCancel(cmd)
+	if user != nil {
+		if err := runAs(cmd, user); err != nil {
+			return err
+		}
+	}
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	return cmd.Run()
+}
+
+func (tp *TaskProcessor) runner() CommandRunner {
+	if tp.Runner != nil {
+		return tp.Runner
+	}
+	if !tp.Task.useShell() {
+		return directRunner{}
+	}
+	return shellRunner{}
+}
+
+// runSeparatedOutput logs stderr lines while the command runs and keeps stdout apart in CommandStdout
+func (tp *TaskProcessor) runSeparatedOutput(ctx context.Context, cmdLine string, user *commandUser, stderr io.Writer, outputFile *os.File) error {
+	stdout := newHeadTailBuffer(int(maxCommandOutput))
+	var stdoutWriter io.Writer = stdout
+	if outputFile != nil {
+		stdoutWriter = io.MultiWriter(stdout, outputFile)
+	}
+	stderrReader, stderrWriter := io.Pipe()
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderrReader)
+		scanner.Split(scanLinesOrCarriageReturns)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				tp.debugf("%s: stderr: %s", tp.Task.Name, line)
+				_, _ = fmt.Fprintln(stderr, line)
+			}
+		}
+		// Keep draining if the scanner gave up (line too long), the command would block otherwise
+		_, _ = io.Copy(stderr, stderrReader)
+	}()
+	err := tp.runner().Run(ctx, tp.Task.dir, cmdLine, user, stdoutWriter, stderrWriter)
+	_ = stderrWriter.Close()
+	<-stderrDone
+	tp.CommandStdout = stdout.String()
+	return err
+}
+
+// scanLinesOrCarriageReturns like bufio.ScanLines but also splits progress lines ending with \r
+func scanLinesOrCarriageReturns(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// templateValues placeholders available in commands, inputPath is the file to process
+func (tp *TaskProcessor) templateValues(inputPath, resultFolder string) map[string]string {
+	basename := path.Base(inputPath)
+	extension := path.Ext(basename)
+	return map[string]string{
+		"result_folder":   resultFolder,
+		"previous_output": inputPath,
+		"original_name":   base64.StdEncoding.EncodeToString([]byte(tp.OriginalFilename)),
+		"folder":          path.Dir(inputPath),
+		"name":            strings.TrimSuffix(basename, extension),
+		"extension":       strings.TrimPrefix(extension, "."),
+		// Comes from the client, quoted so it can't inject commands
+		"original_basename": shellQuote(strings.TrimSuffix(tp.OriginalFilename, tp.OriginalExtension)),
+		"original_name_raw": shellQuote(tp.OriginalFilename),
+		"timestamp":         strconv.FormatInt(tp.UploadTime.Unix(), 10),
+		"job_id":            strconv.FormatInt(tp.JobID, 10),
+		"gpu_device":        tp.gpuDevice,
+		"quality":           tp.Task.quality(tp.fileExtension),
+	}
+}
+
+// postCommandValues placeholders available in post_command, run once the processed file was uploaded and removed
+func (tp *TaskProcessor) postCommandValues(originalHash, processedHash string) map[string]string {
+	return map[string]string{
+		"task": tp.Task.Name,
+		// Come from the client, quoted so they can't inject commands
+		"original_filename":  shellQuote(tp.OriginalFilename),
+		"processed_filename": shellQuote(tp.ProcessedFilename),
+		"original_size":      strconv.FormatInt(tp.OriginalSize, 10),
+		"processed_size":     strconv.FormatInt(tp.ProcessedSize, 10),
+		"original_hash":      originalHash,
+		"processed_hash":     processedHash,
+		"timestamp":          strconv.FormatInt(tp.UploadTime.Unix(), 10),
+		"job_id":             strconv.FormatInt(tp.JobID, 10),
+	}
+}
+
+// RunPostCommand runs the task post_command, if any. Its failure is only logged, the upload is already done
+func (tp *TaskProcessor) RunPostCommand(ctx context.Context, originalHash, processedHash string) {
+	if tp.Task.PostCommandTemplate == nil {
+		return
+	}
+	var cmdLine bytes.Buffer
+	if err := tp.Task.PostCommandTemplate.Execute(&cmdLine, tp.postCommandValues(originalHash, processedHash)); err != nil {
+		tp.warnf("unable to generate post_command: %v", err)
+		return
+	}
+	tp.debugf("running post_command: %s: %s", tp.Task.Name, cmdLine.String())
+	if tp.Task.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tp.Task.Timeout)
+		defer cancel()
+	}
+	output := newHeadTailBuffer(int(maxCommandOutput))
+	if err := tp.runner().Run(ctx, tp.Task.dir, cmdLine.String(), tp.Task.runAsUser(), output, output); err != nil {
+		tp.warnf("post_command failed: %v while running command:\n%s\nOutput:\n%s", err, cmdLine.String(), output.String())
+	}
+}
+
+// shellQuote single quotes s for sh, it stays a single word whatever it contains
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runCommand kind: what's being run, used in logs. inputPath: file to process, resultFolder: where the command writes its output
+func (tp *TaskProcessor) runCommand(ctx context.Context, kind string, commandTemplate *template.Template, inputPath, resultFolder string) (err error) {
+	values := tp.templateValues(inputPath, resultFolder)
+	var cmdLine bytes.Buffer
+	err = commandTemplate.Execute(&cmdLine, values)
+	if err != nil {
+		return fmt.Errorf("unable to generate command to be Run: %w", err)
+	}
+	tp.debugf("running %s: %s: %s", kind, tp.Task.Name, cmdLine.String())
+	if tp.Task.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tp.Task.Timeout)
+		defer cancel()
+	}
+	user := tp.Task.runAsUser()
+	if user != nil {
+		// The files created by IUO are only accessible by its own user
+		if err = user.own(inputPath, resultFolder); err != nil {
+			return fmt.Errorf("unable to give files to run_as user: %w", err)
+		}
+	}
+	output := newHeadTailBuffer(int(maxCommandOutput))
+	var outputWriter io.Writer = output
+	var outputFile *os.File
+	if commandOutputDir != "" {
+		if outputFile, err = os.CreateTemp(commandOutputDir, values["name"]+"-*.log"); err != nil {
+			tp.warnf("unable to create command output file: %v", err)
+		} else {
+			defer outputFile.Close()
+			outputWriter = io.MultiWriter(output, outputFile)
+		}
+	}
+	if tp.Task.SeparateOutput {
+		err = tp.runSeparatedOutput(ctx, cmdLine.String(), user, outputWriter, outputFile)
+	} else {
+		err = tp.runner().Run(ctx, tp.Task.dir, cmdLine.String(), user, outputWriter, outputWriter)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", tp.Task.Timeout)
+	} else if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		err = fmt.Errorf("cancelled: %w", ctx.Err())
+	}
+	if err != nil {
+		if tp.Task.SeparateOutput {
+			err = fmt.Errorf("%w while running command:\n%s\nStderr:\n%s\nStdout:\n%s", err, cmdLine.String(), output.String(), tp.CommandStdout)
+		} else {
+			err = fmt.Errorf("%w while running command:\n%s\nOutput:\n%s", err, cmdLine.String(), output.String())
+		}
+		if outputFile != nil {
+			err = fmt.Errorf("%w\nFull output: %s", err, outputFile.Name())
+		}
+		return err
+	}
+	if outputFile != nil {
+		_ = os.Remove(outputFile.Name())
+	}
+	return nil
+}
+
+// runTool runs a binary used by IUO itself (exiftool, ffmpeg...) like the task commands: same runner, run_as user and timeout.
+// Returns its stdout
+func (tp *TaskProcessor) runTool(ctx context.Context, binary string, args ...string) (string, error) {
+	if tp.Task.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tp.Task.Timeout)
+		defer cancel()
+	}
+	cmdLine := shellQuote(binary)
+	for _, arg := range args {
+		cmdLine += " " + shellQuote(arg)
+	}
+	tp.debugf("running %s: %s: %s", path.Base(binary), tp.Task.Name, cmdLine)
+	var stdout bytes.Buffer
+	stderr := newHeadTailBuffer(int(maxCommandOutput))
+	if err := tp.runner().Run(ctx, tp.Task.dir, cmdLine, tp.Task.runAsUser(), &stdout, stderr); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", tp.Task.Timeout)
+		}
+		return "", fmt.Errorf("%s: %w: %s", path.Base(binary), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
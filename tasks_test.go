@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useConfig makes tasks the config of the test
+func useConfig(t *testing.T, tasks ...*Task) {
+	t.Helper()
+	previous := config.Load()
+	config.Store(&Config{Tasks: tasks})
+	t.Cleanup(func() { config.Store(previous) })
+}
+
+// multipartFile the file of a parsed upload named filename with content, like the one of a request
+func multipartFile(t *testing.T, filename string, content []byte) (multipart.File, *multipart.FileHeader) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("assetData", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/assets", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	file, header, err := r.FormFile("assetData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = file.Close() })
+	return file, header
+}
+
+func TestNewTaskProcessorUnknownSize(t *testing.T) {
+	useConfig(t,
+		&Task{Name: "small", Extensions: []string{"jpg"}, MaxFilesizeBytes: 10, TempDir: t.TempDir()},
+		&Task{Name: "big", Extensions: []string{"jpg"}, MinFilesizeBytes: 11, TempDir: t.TempDir()},
+	)
+	tests := []struct {
+		content  string
+		wantTask string
+	}{
+		{"small jpg", "small"},
+		{"twenty bytes of jpg.", "big"},
+	}
+	for _, test := range tests {
+		t.Run(test.wantTask, func(t *testing.T) {
+			file, header := multipartFile(t, "photo.jpg", []byte(test.content))
+			taskProcessor, err := newTaskProcessor(context.Background(), file, header.Filename, 0, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer taskProcessor.Close()
+			if taskProcessor.Task.Name != test.wantTask {
+				t.Errorf("task = %s, want %s", taskProcessor.Task.Name, test.wantTask)
+			}
+		})
+	}
+}
+
+// useTask makes task, ready to run, the only one in the config
+func useTask(t *testing.T, task *Task) {
+	t.Helper()
+	if task.TempDir == "" {
+		task.TempDir = t.TempDir()
+	}
+	if err := task.Init(); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, task)
+	initJobSlots()
+}
+
+// initJobSlots the semaphores created by setup in IUO, needed to run a task
+func initJobSlots() {
+	if imageSemaphore == nil {
+		imageSemaphore = make(chan struct{}, 1)
+		videoSemaphore = make(chan struct{}, 1)
+	}
+}
+
+// newTestTaskProcessor the processor of an upload of filename with content, task being the only one in the config
+func newTestTaskProcessor(t *testing.T, task *Task, filename string, content []byte) *TaskProcessor {
+	t.Helper()
+	useTask(t, task)
+	file, header := multipartFile(t, filename, content)
+	taskProcessor, err := newTaskProcessor(context.Background(), file, header.Filename, header.Size, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskProcessor.SetLogger(discardLogger())
+	t.Cleanup(func() { _ = taskProcessor.Close() })
+	return taskProcessor
+}
+
+func TestNewTaskProcessorDeclaredSize(t *testing.T) {
+	useConfig(t, &Task{Name: "jpg", Extensions: []string{"jpg"}, TempDir: t.TempDir()})
+	content := []byte("not really a jpg")
+	tests := []struct {
+		name         string
+		declaredSize int64
+		wantErr      error
+	}{
+		{"not declared", 0, nil},
+		{"declared", int64(len(content)), nil},
+		{"shorter than declared", int64(len(content)) + 100, errCorruptUpload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, header := multipartFile(t, "photo.jpg", content)
+			taskProcessor, err := NewTaskProcessorFromMultipart(context.Background(), file, header, test.declaredSize, "")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if taskProcessor != nil {
+				_ = taskProcessor.Close()
+			}
+		})
+	}
+}
+
+func TestNewTaskProcessorMaxFilesize(t *testing.T) {
+	tempDir := t.TempDir()
+	useConfig(t, &Task{Name: "small", Extensions: []string{"jpg"}, MaxFilesizeBytes: 10, TempDir: tempDir})
+	content := []byte("twenty bytes of jpg.")
+	tests := []struct {
+		name         string
+		size         int64
+		declaredSize int64
+	}{
+		{"measured", int64(len(content)), 0},
+		{"declared", 0, int64(len(content))},
+		// The client announcing less than it sends is stopped by the copy
+		{"understated", 0, 5},
+		{"unknown", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, header := multipartFile(t, "photo.jpg", content)
+			taskProcessor, err := newTaskProcessor(context.Background(), file, header.Filename, test.size, test.declaredSize, "")
+			if err == nil {
+				_ = taskProcessor.Close()
+				t.Fatal("a file bigger than max_filesize got a task")
+			}
+			if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+				t.Errorf("temp file left behind: %s", entries[0].Name())
+			}
+		})
+	}
+}
+
+// fakeRunner writes its files in the result folder, the command line of the task being only {{.result_folder}}
+type fakeRunner struct {
+	files map[string]string
+	err   error
+}
+
+func (runner fakeRunner) Run(ctx context.Context, dir, cmdLine string, user *commandUser, stdout, stderr io.Writer) error {
+	for name, content := range runner.files {
+		if err := os.WriteFile(filepath.Join(cmdLine, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return runner.err
+}
+
+func TestRunWithFakeRunner(t *testing.T) {
+	tests := []struct {
+		name          string
+		runner        fakeRunner
+		wantFilename  string
+		wantSize      int64
+		wantErrPrefix string
+	}{
+		{"one file", fakeRunner{files: map[string]string{"out.avif": "avif"}}, "IMG_0001.avif", 4, ""},
+		{"command failed", fakeRunner{files: map[string]string{"out.avif": "avif"}, err: errors.New("exit status 1")}, "", 0, "exit status 1"},
+		{"no file", fakeRunner{}, "", 0, "unexpected number of files in temp directory: 0"},
+		{"two files", fakeRunner{files: map[string]string{"out.avif": "avif", "out.log": "log"}}, "", 0, "unexpected number of files in temp directory: 2"},
+		{"empty file", fakeRunner{files: map[string]string{"out.avif": ""}}, "", 0, "processed file is empty"},
+		{"not a media file", fakeRunner{files: map[string]string{"out.txt": "text"}}, "", 0, "processed file extension"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			taskProcessor := newTestTaskProcessor(t, &Task{Name: "fake", Extensions: []string{"jpg"}, Command: "{{.result_folder}}"}, "IMG_0001.jpg", []byte("original jpg"))
+			taskProcessor.Runner = test.runner
+			err := taskProcessor.Run(context.Background())
+			if test.wantErrPrefix != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErrPrefix) {
+					t.Fatalf("err = %v, want %s...", err, test.wantErrPrefix)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if taskProcessor.ProcessedFilename != test.wantFilename || taskProcessor.ProcessedSize != test.wantSize {
+				t.Errorf("processed %s (%d bytes), want %s (%d bytes)", taskProcessor.ProcessedFilename, taskProcessor.ProcessedSize, test.wantFilename, test.wantSize)
+			}
+		})
+	}
+}
+
+// blockingRunner records the command line and waits for its context, like a hung command
+type blockingRunner struct {
+	cmdLines *[]string
+}
+
+func (runner blockingRunner) Run(ctx context.Context, dir, cmdLine string, user *commandUser, stdout, stderr io.Writer) error {
+	*runner.cmdLines = append(*runner.cmdLines, cmdLine)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCopyMetadataTimeout(t *testing.T) {
+	taskProcessor := newTestTaskProcessor(t, &Task{Name: "metadata", Extensions: []string{"jpg"}, Command: "true", Timeout: 100 * time.Millisecond}, "it's.jpg", []byte("original jpg"))
+	var cmdLines []string
+	taskProcessor.Runner = blockingRunner{&cmdLines}
+	processed := filepath.Join(t.TempDir(), "out.avif")
+	err := taskProcessor.copyMetadata(context.Background(), taskProcessor.tempOriginalFilePath, processed)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	want := shellQuote(exiftoolPath) + " '-q' '-overwrite_original' '-TagsFromFile' " + shellQuote(taskProcessor.tempOriginalFilePath) + " " + shellQuote(processed)
+	if len(cmdLines) != 1 || cmdLines[0] != want {
+		t.Errorf("ran %q, want %q", cmdLines, want)
+	}
+}
+
+// stepRunner runs "copy <file> <folder>" and "rename <file> <new path>" command lines, recording them
+type stepRunner struct {
+	cmdLines *[]string
+}
+
+func (runner stepRunner) Run(ctx context.Context, dir, cmdLine string, user *commandUser, stdout, stderr io.Writer) error {
+	*runner.cmdLines = append(*runner.cmdLines, cmdLine)
+	args := strings.Fields(cmdLine)
+	switch args[0] {
+	case "copy":
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(args[2], filepath.Base(args[1])), data, 0644)
+	case "rename":
+		return os.Rename(args[1], args[2])
+	}
+	return errors.New("unknown command " + args[0])
+}
+
+func TestRunStepsChain(t *testing.T) {
+	task := &Task{Name: "chain", Extensions: []string{"jpg"}, Commands: []string{
+		"copy {{.folder}}/{{.name}}.{{.extension}} {{.result_folder}}",
+		"rename {{.folder}}/{{.name}}.{{.extension}} {{.result_folder}}/{{.name}}.avif",
+	}}
+	taskProcessor := newTestTaskProcessor(t, task, "IMG_0001.jpg", []byte("original jpg"))
+	var cmdLines []string
+	taskProcessor.Runner = stepRunner{&cmdLines}
+	if err := taskProcessor.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmdLines) != 2 {
+		t.Fatalf("ran %q, want the 2 steps", cmdLines)
+	}
+	// The second step gets the file written by the first one
+	copied := filepath.Join(strings.Fields(cmdLines[0])[2], filepath.Base(strings.Fields(cmdLines[0])[1]))
+	if renamed := strings.Fields(cmdLines[1])[1]; renamed != copied {
+		t.Errorf("second step renamed %s, want the copy %s", renamed, copied)
+	}
+	if _, err := os.Stat(filepath.Dir(copied)); !os.IsNotExist(err) {
+		t.Errorf("the folder of the first step is left: %v", err)
+	}
+	processed, err := io.ReadAll(taskProcessor.ProcessedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskProcessor.ProcessedFilename != "IMG_0001.avif" || string(processed) != "original jpg" {
+		t.Errorf("processed %s %q, want IMG_0001.avif with the original content", taskProcessor.ProcessedFilename, processed)
+	}
+}
+
+// flakyRunner fails its first failures runs, leaving a partial file behind, then writes out.avif like fakeRunner
+type flakyRunner struct {
+	failures int
+	runs     *int
+}
+
+func (runner flakyRunner) Run(ctx context.Context, dir, cmdLine string, user *commandUser, stdout, stderr io.Writer) error {
+	*runner.runs++
+	if *runner.runs <= runner.failures {
+		_ = os.WriteFile(filepath.Join(cmdLine, "partial.avif"), []byte("part"), 0644)
+		return errors.New("device busy")
+	}
+	return os.WriteFile(filepath.Join(cmdLine, "out.avif"), []byte("avif"), 0644)
+}
+
+func TestRunWithRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  uint
+		failures int
+		wantRuns int
+		wantErr  bool
+	}{
+		{"fails once, retried", 1, 1, 2, false},
+		{"fails once, no retries", 0, 1, 1, true},
+		{"fails more than retries", 2, 5, 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := &Task{Name: "flaky", Extensions: []string{"jpg"}, Command: "{{.result_folder}}", Retries: test.retries, RetryDelay: time.Millisecond}
+			taskProcessor := newTestTaskProcessor(t, task, "IMG_0001.jpg", []byte("original jpg"))
+			runs := 0
+			taskProcessor.Runner = flakyRunner{test.failures, &runs}
+			err := taskProcessor.Run(context.Background())
+			if runs != test.wantRuns {
+				t.Errorf("%d runs, want %d", runs, test.wantRuns)
+			}
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "device busy") {
+					t.Errorf("err = %v, want the command failure", err)
+				}
+				return
+			}
+			// The partial file of the failed attempt would make two files in the work dir
+			if err != nil {
+				t.Fatal(err)
+			}
+			if taskProcessor.ProcessedFilename != "IMG_0001.avif" || taskProcessor.ProcessedSize != 4 {
+				t.Errorf("processed %s (%d bytes), want IMG_0001.avif (4 bytes)", taskProcessor.ProcessedFilename, taskProcessor.ProcessedSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// isTmpfs the filesystem of dir is in RAM
+func isTmpfs(dir string) (bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return false, err
+	}
+	// Type is int32 on 32-bit platforms
+	fsType := uint32(stat.Type)
+	return fsType == tmpfsMagic || fsType == ramfsMagic, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func isTmpfs(dir string) (bool, error) {
+	return false, errors.New("tmpfs detection is only supported on linux")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const webhookAttempts = 3
+
+// webhookClient not the upstream one: the webhook receiver isn't Immich, it doesn't get the upstream headers and TLS settings
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookPayload sent to webhook_url once a job uploaded its file
+type webhookPayload struct {
+	JobID            int64  `json:"job_id"`
+	Filename         string `json:"filename"`
+	UploadedFilename string `json:"uploaded_filename"`
+	// Task empty if no task matched the upload
+	Task string `json:"task"`
+	// Optimized false when the original was uploaded
+	Optimized     bool    `json:"optimized"`
+	OriginalSize  int64   `json:"original_size"`
+	ProcessedSize int64   `json:"processed_size"`
+	Ratio         float64 `json:"ratio"`
+}
+
+// optimizedPayload the processed file of the TaskProcessor was uploaded
+func optimizedPayload(taskProcessor *TaskProcessor) webhookPayload {
+	return webhookPayload{
+		JobID:            taskProcessor.JobID,
+		Filename:         taskProcessor.OriginalFilename,
+		UploadedFilename: taskProcessor.ProcessedFilename,
+		Task:             taskProcessor.Task.Name,
+		Optimized:        true,
+		OriginalSize:     taskProcessor.OriginalSize,
+		ProcessedSize:    taskProcessor.ProcessedSize,
+	}
+}
+
+// notifyWebhook sends the payload in the background, retrying a few times. It never delays or fails the upload, errors are only logged
+func notifyWebhook(payload webhookPayload, logger *customLogger) {
+	if webhookURL == "" || (!payload.Optimized && !webhookOnPassthrough) {
+		return
+	}
+	if payload.OriginalSize > 0 {
+		payload.Ratio = float64(payload.ProcessedSize) / float64(payload.OriginalSize)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warnf("webhook: %v", err)
+		return
+	}
+	go func() {
+		for attempt := 1; ; attempt++ {
+			err := postWebhook(body)
+			if err == nil {
+				return
+			}
+			if attempt == webhookAttempts {
+				logger.Warnf("webhook failed %d times, giving up: %v", attempt, err)
+				return
+			}
+			logger.Debugf("webhook failed, retrying: %v", err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}()
+}
+
+func postWebhook(body []byte) error {
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
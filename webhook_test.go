@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWebhookPayload(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s %s, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer webhook.Close()
+	previous := webhookURL
+	webhookURL = webhook.URL
+	defer func() { webhookURL = previous }()
+	recordingUpstream(t)
+	useChecksumStore(t)
+	useTask(t, &Task{Name: "avif", Extensions: []string{"jpg"}, Command: `printf avif > "{{.result_folder}}/{{.name}}.avif"`})
+
+	if err := newJob(clientUpload(t, "photo.jpg", []byte("original jpg")), httptest.NewRecorder(), discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	select {
+	case body = <-bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	wantKeys := []string{"filename", "job_id", "optimized", "original_size", "processed_size", "ratio", "task", "uploaded_filename"}
+	if keys := slices.Sorted(maps.Keys(payload)); !slices.Equal(keys, wantKeys) {
+		t.Errorf("payload keys %v, want %v", keys, wantKeys)
+	}
+	want := map[string]any{
+		"filename":          "photo.jpg",
+		"uploaded_filename": "photo.avif",
+		"task":              "avif",
+		"optimized":         true,
+		"original_size":     float64(12),
+		"processed_size":    float64(4),
+		"ratio":             float64(4) / 12,
+	}
+	for key, value := range want {
+		if payload[key] != value {
+			t.Errorf("%s = %v, want %v", key, payload[key], value)
+		}
+	}
+	if jobID, ok := payload["job_id"].(float64); !ok || jobID < 1 {
+		t.Errorf("job_id = %v, want the job number", payload["job_id"])
+	}
+}
@@ -5,11 +5,30 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// activeWebSockets proxied websocket connections, limited by max_websockets
+var activeWebSockets atomic.Int64
+
+// webSocketDeadline the connection is dropped if nothing is read or written before it, Immich pings every 25s
+func webSocketDeadline() time.Time {
+	if webSocketIdleTimeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(webSocketIdleTimeout)
+}
+
+// isWebSocketClosed the connection was closed by the other direction of the proxy, nothing to log
+func isWebSocketClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
+
 // WebSocket42 A message starting with the number 42 and then a JSON array. The 1st element is the action/event e.g. on_upload_success, on_asset_delete. Other elements vary depending on the action
 type WebSocket42 []any
 
@@ -49,13 +68,23 @@ func handleWebSocketConn(cliConn, srvConn *websocket.Conn, logger *customLogger)
 	var wg sync.WaitGroup
 	wg.Add(2)
 	logger.SetErrPrefix("websocket proxy")
+	// When one side is gone the other one is closed too, its read would block until the idle timeout otherwise
+	closeBoth := sync.OnceFunc(func() {
+		_ = cliConn.Close()
+		_ = srvConn.Close()
+	})
 	go func() {
 		defer wg.Done()
+		defer closeBoth()
 		var err error
 		var msgType int
 		var message []byte
 		for {
-			if msgType, message, err = srvConn.ReadMessage(); logger.Error(err, "srv ReadMessage") {
+			_ = srvConn.SetReadDeadline(webSocketDeadline())
+			if msgType, message, err = srvConn.ReadMessage(); err != nil {
+				if !isWebSocketClosed(err) {
+					logger.Error(err, "srv ReadMessage")
+				}
 				break
 			}
 			//fmt.Printf("SRV: Type: %d Message: %s\n", msgType, message)
@@ -72,17 +101,16 @@ func handleWebSocketConn(cliConn, srvConn *websocket.Conn, logger *customLogger)
 					asset = wsMsg.getUploadReadyAsset()
 				}
 				if asset != nil {
-					mapLock.RLock()
 					asset.toOriginalAsset()
-					mapLock.RUnlock()
 					if message, err = json.Marshal(wsMsg); logger.Error(err, "json encode") {
 						continue
 					}
 					message = append([]byte("42"), message...)
 				}
 			}
+			_ = cliConn.SetWriteDeadline(webSocketDeadline())
 			if err = cliConn.WriteMessage(msgType, message); err != nil {
-				if !errors.Is(err, websocket.ErrCloseSent) {
+				if !errors.Is(err, websocket.ErrCloseSent) && !isWebSocketClosed(err) {
 					logger.Error(err, "cli WriteMessage")
 					break
 				}
@@ -92,11 +120,16 @@ func handleWebSocketConn(cliConn, srvConn *websocket.Conn, logger *customLogger)
 	}()
 	go func() {
 		defer wg.Done()
+		defer closeBoth()
 		var err error
 		var msgType int
 		var message []byte
 		for {
+			_ = cliConn.SetReadDeadline(webSocketDeadline())
 			if msgType, message, err = cliConn.ReadMessage(); err != nil {
+				if isWebSocketClosed(err) {
+					break
+				}
 				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure) {
 					logger.Error(err, "client disconnect")
 					break
@@ -104,7 +137,11 @@ func handleWebSocketConn(cliConn, srvConn *websocket.Conn, logger *customLogger)
 				logger.Error(err, "cli ReadMessage")
 				break
 			}
-			if err = srvConn.WriteMessage(msgType, message); logger.Error(err, "srv WriteMessage") {
+			_ = srvConn.SetWriteDeadline(webSocketDeadline())
+			if err = srvConn.WriteMessage(msgType, message); err != nil {
+				if !isWebSocketClosed(err) {
+					logger.Error(err, "srv WriteMessage")
+				}
 				break
 			}
 		}
@@ -115,7 +152,14 @@ func handleWebSocketConn(cliConn, srvConn *websocket.Conn, logger *customLogger)
 func upgradeWebSocketRequest(w http.ResponseWriter, r *http.Request, logger *customLogger) {
 	var err error
 	logger.SetErrPrefix("websocket")
-	logger.Printf("websocket proxy: client connection upgrade")
+	active := activeWebSockets.Add(1)
+	defer activeWebSockets.Add(-1)
+	if maxWebSockets > 0 && active > int64(maxWebSockets) {
+		logger.Warnf("websocket proxy: max_websockets (%d) reached, upgrade refused", maxWebSockets)
+		http.Error(w, "too many websocket connections", http.StatusServiceUnavailable)
+		return
+	}
+	logger.Debugf("websocket proxy: client connection upgrade, %d active", active)
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -126,7 +170,14 @@ func upgradeWebSocketRequest(w http.ResponseWriter, r *http.Request, logger *cus
 		return
 	}
 	defer cliConn.Close()
-	if srvConn, _, err = websocket.DefaultDialer.Dial("ws"+upstreamURL[strings.Index(upstreamURL, ":"):]+r.URL.String(), webSocketSafeHeader(r.Header)); logger.Error(err, "dial") {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = upstreamTLSConfig()
+	header := webSocketSafeHeader(r.Header)
+	for key, values := range upstreamHeaders.header {
+		header[key] = values
+	}
+	// http://immich -> ws://immich, https://immich -> wss://immich
+	if srvConn, _, err = dialer.Dial("ws"+strings.TrimPrefix(upstreamURL, "http")+r.URL.String(), header); logger.Error(err, "dial") {
 		return
 	}
 	defer srvConn.Close()